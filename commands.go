@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"pg-backup/internal/backup"
+	"pg-backup/internal/catalog"
+	"pg-backup/internal/logger"
+	"pg-backup/internal/storage"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] [command]
+
+Without a command the backup scheduler is started.
+
+Commands:
+  wal-push <path> [name]   archive a WAL file (archive_command = '... wal-push %%p %%f')
+  wal-fetch <name> <path>  restore an archived WAL file (restore_command = '... wal-fetch %%f %%p')
+  restore-pitr -data-dir <dir> (-target-time <time> | -target-lsn <lsn> | -target-xid <xid>)
+                           prepare a data directory for point-in-time recovery
+  list-backups [-database <name>] [-since <time>] [-until <time>] [-format table|json]
+                           list stored backups
+  inspect [-format table|json] <backup>
+                           show the manifest and verification status of a backup
+  prune [-dry-run] [-format table|json]
+                           apply retention, showing which backups are kept or deleted and why
+  check                    re-hash stored backups and compare them with their manifests
+  verify                   restore the newest backups into scratch databases and check them
+
+Flags:
+`, filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
+
+// runCommand executes a subcommand and returns the process exit code.
+// Errors go to stderr as well as the log so that PostgreSQL records them
+// when the command runs as archive_command or restore_command.
+func runCommand(backupService *backup.Service, appLogger *logger.Logger, configFile, serverName string, args []string) int {
+	var err error
+	switch args[0] {
+	case "wal-push":
+		if len(args) < 2 || len(args) > 3 {
+			return usageError("wal-push requires <path> [name]")
+		}
+		name := filepath.Base(args[1])
+		if len(args) == 3 {
+			name = args[2]
+		}
+		err = backupService.PushWAL(serverName, args[1], name)
+	case "wal-fetch":
+		if len(args) != 3 {
+			return usageError("wal-fetch requires <name> <path>")
+		}
+		err = backupService.FetchWAL(serverName, args[1], args[2])
+		if errors.Is(err, storage.ErrNotFound) {
+			// Expected at the end of archive recovery; not worth an error.
+			return 1
+		}
+	case "restore-pitr":
+		return restorePITR(backupService, appLogger, configFile, serverName, args[1:])
+	case "list-backups":
+		return listBackups(backupService, serverName, args[1:])
+	case "inspect":
+		return inspectBackup(backupService, serverName, args[1:])
+	case "prune":
+		return pruneBackups(backupService, appLogger, serverName, args[1:])
+	case "check":
+		if len(args) != 1 {
+			return usageError("check takes no arguments")
+		}
+		var results []backup.CheckResult
+		results, err = backupService.Check(serverName)
+		printCheckResults(results)
+	case "verify":
+		if len(args) != 1 {
+			return usageError("verify takes no arguments")
+		}
+		var verified int
+		verified, err = backupService.Verify(serverName)
+		if err == nil {
+			fmt.Printf("Verified %d backups\n", verified)
+		}
+	default:
+		return usageError(fmt.Sprintf("unknown command %q", args[0]))
+	}
+
+	if err != nil {
+		appLogger.Error("%s failed: %v", args[0], err)
+		fmt.Fprintf(os.Stderr, "pg-backup %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func printCheckResults(results []backup.CheckResult) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "STATUS\tDESTINATION\tBACKUP\tDETAILS")
+	for _, result := range results {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", result.Status, result.Destination, result.Artifact, result.Error)
+	}
+	writer.Flush()
+}
+
+func usageError(message string) int {
+	fmt.Fprintf(os.Stderr, "%s\n\n", message)
+	flag.Usage()
+	return 2
+}
+
+func restorePITR(backupService *backup.Service, appLogger *logger.Logger, configFile, serverName string, args []string) int {
+	flags := flag.NewFlagSet("restore-pitr", flag.ContinueOnError)
+	var (
+		dataDir      = flags.String("data-dir", "", "Empty data directory to restore into")
+		targetTime   = flags.String("target-time", "", "Recover up to this time (RFC 3339 or \"2006-01-02 15:04:05\" local time)")
+		targetLSN    = flags.String("target-lsn", "", "Recover up to this WAL position, e.g. 0/3000060")
+		targetXID    = flags.String("target-xid", "", "Recover up to this transaction ID")
+		targetAction = flags.String("target-action", "pause", "Action once the target is reached: pause, promote or shutdown")
+		base         = flags.String("base", "", "Use this base backup instead of picking one")
+	)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := backup.PITROptions{
+		Server:  serverName,
+		DataDir: *dataDir,
+		Base:    *base,
+		Target: backup.RestoreTarget{
+			LSN:    *targetLSN,
+			XID:    *targetXID,
+			Action: *targetAction,
+		},
+	}
+
+	targets := 0
+	for _, target := range []string{*targetTime, *targetLSN, *targetXID} {
+		if target != "" {
+			targets++
+		}
+	}
+	if *dataDir == "" || targets != 1 {
+		fmt.Fprintln(os.Stderr, "restore-pitr requires -data-dir and exactly one of -target-time, -target-lsn or -target-xid")
+		flags.Usage()
+		return 2
+	}
+	switch *targetAction {
+	case "pause", "promote", "shutdown":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -target-action %q\n", *targetAction)
+		return 2
+	}
+	if *targetTime != "" {
+		t, err := catalog.ParseTime(*targetTime)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -target-time: %v\n", err)
+			return 2
+		}
+		opts.Target.Time = t
+	}
+
+	restoreCommand, err := walFetchCommand(configFile, serverName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "restore-pitr: %v\n", err)
+		return 1
+	}
+	opts.RestoreCommand = restoreCommand
+
+	info, err := backupService.RestorePITR(opts)
+	if err != nil {
+		appLogger.Error("restore-pitr failed: %v", err)
+		fmt.Fprintf(os.Stderr, "pg-backup restore-pitr: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Restored base backup %s into %s\n", info.Archive, *dataDir)
+	fmt.Printf("Recovery is configured; start PostgreSQL on %s to replay WAL up to the target.\n", *dataDir)
+	return 0
+}
+
+// walFetchCommand builds the restore_command that runs this executable's
+// wal-fetch with the same configuration.
+func walFetchCommand(configFile, serverName string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate executable: %w", err)
+	}
+	configPath, err := filepath.Abs(configFile)
+	if err != nil {
+		return "", err
+	}
+
+	command := []string{shellQuote(executable), "-config", shellQuote(configPath)}
+	if serverName != "" {
+		command = append(command, "-server", shellQuote(serverName))
+	}
+	command = append(command, "wal-fetch", "%f", "%p")
+	return strings.Join(command, " "), nil
+}
+
+func shellQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t'\"\\$`;&|<>()*?[]#~%") {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func listBackups(backupService *backup.Service, serverName string, args []string) int {
+	flags := flag.NewFlagSet("list-backups", flag.ContinueOnError)
+	var (
+		database = flags.String("database", "", "Only list backups of this database")
+		since    = flags.String("since", "", "Only list backups taken at or after this time")
+		until    = flags.String("until", "", "Only list backups taken before this time")
+		format   = flags.String("format", "table", "Output format: table or json")
+	)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 || (*format != "table" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "list-backups takes no arguments and -format must be table or json")
+		flags.Usage()
+		return 2
+	}
+
+	filter := catalog.Filter{Server: serverName, Database: *database}
+	var err error
+	if *since != "" {
+		if filter.Since, err = catalog.ParseTime(*since); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -since: %v\n", err)
+			return 2
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = catalog.ParseTime(*until); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -until: %v\n", err)
+			return 2
+		}
+	}
+
+	entries, err := backupService.Catalog(filter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pg-backup list-backups: %v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		return printJSON(entries)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "SERVER\tBACKUP\tKIND\tDATABASE\tTIME\tSIZE\tVERIFIED")
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Server, entry.Name, entry.Kind, valueOr(entry.Database, "-"),
+			entry.Time.Format("2006-01-02 15:04:05"), formatBytes(entry.Size), verificationState(entry.Verification))
+	}
+	writer.Flush()
+	return 0
+}
+
+func inspectBackup(backupService *backup.Service, serverName string, args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	format := flags.String("format", "table", "Output format: table or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*format != "table" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "inspect requires <backup> and -format must be table or json")
+		flags.Usage()
+		return 2
+	}
+
+	entry, err := backupService.Inspect(serverName, flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "pg-backup inspect: %v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		return printJSON(entry)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	field := func(name, value string) {
+		fmt.Fprintf(writer, "%s:\t%s\n", name, value)
+	}
+	field("Backup", entry.Name)
+	field("Server", entry.Server)
+	field("Kind", entry.Kind)
+	if entry.Database != "" {
+		field("Database", entry.Database)
+	}
+	field("Time", entry.Time.Format("2006-01-02 15:04:05"))
+	field("Age", time.Since(entry.Time).Round(time.Second).String())
+	field("Size", fmt.Sprintf("%s (%d bytes)", formatBytes(entry.Size), entry.Size))
+
+	if entry.HasManifest {
+		field("Uncompressed", fmt.Sprintf("%s (%d bytes)", formatBytes(entry.RawSize), entry.RawSize))
+		field("SHA-256", entry.SHA256)
+		field("Tool version", valueOr(entry.ToolVersion, "unknown"))
+		field("Server version", valueOr(entry.ServerVersion, "unknown"))
+		field("Options", valueOr(strings.Join(entry.Options, " "), "none"))
+	} else {
+		field("Manifest", "none")
+	}
+
+	if verification := entry.Verification; verification != nil {
+		state := verificationState(verification)
+		if verification.Error != "" {
+			state += ": " + verification.Error
+		}
+		field("Verification", state)
+		field("Verified at", verification.VerifiedAt.Format("2006-01-02 15:04:05"))
+		field("Tables restored", fmt.Sprintf("%d", verification.Tables))
+	} else {
+		field("Verification", "never verified")
+	}
+	writer.Flush()
+	return 0
+}
+
+func pruneBackups(backupService *backup.Service, appLogger *logger.Logger, serverName string, args []string) int {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	var (
+		dryRun = flags.Bool("dry-run", false, "Only show what would be deleted")
+		format = flags.String("format", "table", "Output format: table or json")
+	)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 || (*format != "table" && *format != "json") {
+		fmt.Fprintln(os.Stderr, "prune takes no arguments and -format must be table or json")
+		flags.Usage()
+		return 2
+	}
+
+	decisions, err := backupService.Prune(serverName, *dryRun)
+	if *format == "json" {
+		if code := printJSON(decisions); code != 0 {
+			return code
+		}
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "ACTION\tDESTINATION\tBACKUP\tREASON")
+		for _, decision := range decisions {
+			action := "keep"
+			if !decision.Keep && *dryRun {
+				action = "would delete"
+			} else if !decision.Keep {
+				action = "delete"
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", action, decision.Destination, decision.Artifact, decision.Reason)
+		}
+		writer.Flush()
+	}
+
+	if err != nil {
+		appLogger.Error("prune failed: %v", err)
+		fmt.Fprintf(os.Stderr, "pg-backup prune: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func printJSON(value any) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode output: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func verificationState(verification *catalog.Verification) string {
+	switch {
+	case verification == nil:
+		return "-"
+	case verification.Success:
+		return "ok"
+	default:
+		return "failed"
+	}
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// formatBytes renders a size with binary units, matching the units accepted
+// by min_size and max_size.
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	for _, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		value /= unit
+		if value < unit || suffix == "TB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return ""
+}
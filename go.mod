@@ -5,8 +5,14 @@ go 1.21
 require (
 	github.com/aws/aws-sdk-go v1.45.0
 	github.com/lib/pq v1.10.9
+	github.com/pkg/sftp v1.13.6
 	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.31.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/jmespath/go-jmespath v0.4.0 // indirect
+require (
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
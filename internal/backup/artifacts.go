@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"sort"
+	"time"
+
+	"pg-backup/internal/config"
+	"pg-backup/internal/storage"
+)
+
+// timestampFormat is used in every backup file name.
+const timestampFormat = "2006-01-02_15-04-05"
+
+// Artifact kinds, derived from the file name or its {kind} placeholder.
+const (
+	KindDatabase   = "database"
+	KindFullDump   = "full_dump"
+	KindGlobals    = "globals"
+	KindBaseBackup = "basebackup"
+)
+
+// artifact is a backup file found in storage.
+type artifact struct {
+	name string
+	// key groups artifacts of the same source: the database name, or the
+	// kind for server-wide backups.
+	key     string
+	kind    string
+	time    time.Time
+	size    int64
+	modTime time.Time
+}
+
+// listArtifacts returns the backups stored for server, oldest first.
+func (s *Service) listArtifacts(server config.Server) ([]artifact, error) {
+	objects, err := s.storage.List(newNamePattern(server).listPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return findArtifacts(server, objects), nil
+}
+
+// findArtifacts picks the backups of server out of a storage listing,
+// oldest first. Sidecar files, WAL and objects belonging to other servers
+// are ignored.
+func findArtifacts(server config.Server, objects []storage.Object) []artifact {
+	pattern := newNamePattern(server)
+	var artifacts []artifact
+	for _, object := range objects {
+		if a, ok := pattern.parse(object.Name); ok {
+			a.size = object.Size
+			a.modTime = object.ModTime
+			artifacts = append(artifacts, a)
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].time.Before(artifacts[j].time)
+	})
+	return artifacts
+}
@@ -3,10 +3,15 @@ package backup
 import (
 	"bytes"
 	"compress/gzip"
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"pg-backup/internal/config"
@@ -17,129 +22,296 @@ import (
 )
 
 type Service struct {
+	mu       sync.RWMutex
 	dbConfig *config.Config
 	storage  storage.Provider
 	logger   *logger.Logger
+	observer Observer
+	sidecars *sidecarCache
+	use      *providerUse
 }
 
 func NewService(dbConfig *config.Config, storage storage.Provider, logger *logger.Logger) *Service {
-	return &Service{
+	s := &Service{
 		dbConfig: dbConfig,
 		storage:  storage,
 		logger:   logger,
+		sidecars: newSidecarCache(),
+		use:      &providerUse{provider: storage, logger: logger},
 	}
+	s.watchDestinations(storage)
+	return s
 }
 
-func (s *Service) BackupAll() (int, error) {
-	// Check if full dump is enabled
-	if s.dbConfig.FullDump {
-		s.logger.Info("Full dump mode enabled, creating single backup file for entire server")
-		err := s.backupFullServer()
-		if err != nil {
-			s.logger.Error("Failed to perform full dump: %v", err)
-			return 0, err
-		}
-		s.logger.Info("Full dump completed successfully")
-		return 1, nil
+// Reload swaps in a new configuration and storage provider. Runs that are
+// already in progress keep using the settings they started with; the old
+// provider is closed once the last of them has finished.
+func (s *Service) Reload(dbConfig *config.Config, storage storage.Provider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dbConfig = dbConfig
+	s.storage = storage
+	s.sidecars = newSidecarCache()
+	s.use.replace()
+	s.use = &providerUse{provider: storage, logger: s.logger}
+	s.watchDestinations(storage)
+}
+
+// providerUse counts the runs using a storage provider, so that a provider
+// replaced by Reload is closed only when no run needs it any more.
+type providerUse struct {
+	provider storage.Provider
+	logger   *logger.Logger
+
+	mu       sync.Mutex
+	runs     int
+	replaced bool
+}
+
+func (u *providerUse) acquire() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.runs++
+}
+
+func (u *providerUse) release() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.runs--
+	if u.runs == 0 && u.replaced {
+		u.close()
 	}
+}
 
-	databases := s.dbConfig.Database.Databases
+func (u *providerUse) replace() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.replaced = true
+	if u.runs == 0 {
+		u.close()
+	}
+}
 
-	// If no databases specified, discover all databases
-	if len(databases) == 0 {
-		s.logger.Info("No specific databases configured, discovering all databases")
-		discoveredDbs, err := s.discoverDatabases()
-		if err != nil {
-			s.logger.Error("Failed to discover databases: %v", err)
-			return 0, err
+func (u *providerUse) close() {
+	if u.provider == nil {
+		return
+	}
+	if err := storage.Close(u.provider); err != nil {
+		u.logger.Warning("Failed to close the previous storage provider: %v", err)
+	}
+}
+
+// watchDestinations reports the outcome of every write to each destination
+// to the observer, and logs failures when there are several destinations so
+// a partial failure is visible even if the run succeeds.
+func (s *Service) watchDestinations(provider storage.Provider) {
+	multi, ok := provider.(*storage.Multi)
+	if !ok {
+		return
+	}
+	several := len(multi.Targets()) > 1
+	multi.SetReporter(func(destination, filename string, err error) {
+		if err != nil && several {
+			s.logger.Warning("Failed to store %s on destination %s: %v", filename, destination, err)
 		}
-		databases = discoveredDbs
-		s.logger.Info("Discovered %d databases: %s", len(databases), strings.Join(databases, ", "))
+		s.mu.RLock()
+		observer := s.observer
+		s.mu.RUnlock()
+		if observer != nil {
+			observer.DestinationStored(destination, filename, err)
+		}
+	})
+}
+
+// snapshot returns a copy of the service bound to the current settings so a
+// run is not affected by a concurrent Reload. The run must call release
+// when it is done with the storage provider.
+func (s *Service) snapshot() *Service {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.use.acquire()
+	return &Service{
+		dbConfig: s.dbConfig,
+		storage:  s.storage,
+		logger:   s.logger,
+		observer: s.observer,
+		sidecars: s.sidecars,
+		use:      s.use,
 	}
+}
 
-	for _, database := range databases {
-		s.logger.Info("Starting backup for database: %s", database)
+// release ends a run started with snapshot.
+func (s *Service) release() {
+	s.use.release()
+}
+
+// Observer is notified when the backup of a server or the verification of
+// a database finishes, and of every write to a storage destination.
+type Observer interface {
+	ServerBackupFinished(server string, started time.Time, databases int, err error)
+	VerificationFinished(server, database string, finished time.Time, err error)
+	DestinationStored(destination, filename string, err error)
+}
+
+// SetObserver registers an observer for per-server backup outcomes.
+func (s *Service) SetObserver(observer Observer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.observer = observer
+}
+
+// BackupAll backs up every configured server. A failing server does not
+// stop the others; the returned error joins all failures.
+func (s *Service) BackupAll() (int, error) {
+	job := s.snapshot()
+	defer job.release()
+
+	var names []string
+	for _, server := range job.dbConfig.ServerList() {
+		names = append(names, server.Name)
+	}
+	return job.backupServers(names)
+}
+
+// BackupServers backs up the named servers, as used by schedules that only
+// apply to some of them.
+func (s *Service) BackupServers(names []string) (int, error) {
+	job := s.snapshot()
+	defer job.release()
+	return job.backupServers(names)
+}
+
+func (s *Service) backupServers(names []string) (int, error) {
+	servers := make(map[string]config.Server)
+	for _, server := range s.dbConfig.ServerList() {
+		servers[server.Name] = server
+	}
 
-		err := s.backupDatabase(database)
+	total := 0
+	var errs []error
+	for _, name := range names {
+		server, ok := servers[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("server %s is not configured", name))
+			continue
+		}
+
+		start := time.Now()
+		count, err := s.backupServer(server)
+		if s.observer != nil {
+			s.observer.ServerBackupFinished(server.Name, start, count, err)
+		}
 		if err != nil {
-			s.logger.Error("Failed to backup database %s: %v", database, err)
-			return 0, err
+			errs = append(errs, fmt.Errorf("server %s: %w", server.Name, err))
+			continue
 		}
+		total += count
 
-		s.logger.Info("Successfully backed up database: %s", database)
+		if err := s.applyRetention(server); err != nil {
+			s.logger.Warning("Retention for server %s failed: %v", server.Name, err)
+		}
+
+		verification := s.dbConfig.Verification
+		if verification.Enabled && verification.AfterBackup && server.Mode == config.ModeLogical && !server.FullDump {
+			if _, err := s.verifyServer(server); err != nil {
+				s.logger.Error("Verification for server %s failed: %v", server.Name, err)
+			}
+		}
 	}
 
-	return len(databases), nil
+	return total, errors.Join(errs...)
 }
 
-func (s *Service) discoverDatabases() ([]string, error) {
-	connStr := fmt.Sprintf("host=%s port=%d user=%s dbname=postgres sslmode=disable",
-		s.dbConfig.Database.Host,
-		s.dbConfig.Database.Port,
-		s.dbConfig.Database.User,
-	)
+func (s *Service) backupServer(server config.Server) (int, error) {
+	s.logger.Info("Starting backup of server %s (%s:%d)", server.Name, server.Host, server.Port)
 
-	if s.dbConfig.Database.Password != "" {
-		connStr += fmt.Sprintf(" password=%s", s.dbConfig.Database.Password)
+	if server.Mode == config.ModePhysical {
+		s.logger.Info("Physical mode enabled, taking a base backup of the entire server")
+		err := s.backupPhysical(server)
+		if err != nil {
+			s.logger.Error("Failed to take base backup: %v", err)
+			return 0, err
+		}
+		s.logger.Info("Base backup completed successfully")
+		return 1, nil
 	}
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	// Check if full dump is enabled
+	if server.FullDump {
+		s.logger.Info("Full dump mode enabled, creating single backup file for entire server")
+		err := s.backupFullServer(server)
+		if err != nil {
+			s.logger.Error("Failed to perform full dump: %v", err)
+			return 0, err
+		}
+		s.logger.Info("Full dump completed successfully")
+		return 1, nil
 	}
-	defer db.Close()
 
-	err = db.Ping()
+	databases, err := s.Databases(server)
 	if err != nil {
-		return nil, fmt.Errorf("failed to ping PostgreSQL: %w", err)
+		s.logger.Error("Failed to discover databases: %v", err)
+		return 0, err
 	}
 
-	query := `
-		SELECT datname 
-		FROM pg_database 
-		WHERE datistemplate = false 
-		AND datname NOT IN ('postgres')
-		ORDER BY datname
-	`
+	for _, database := range databases {
+		s.logger.Info("Starting backup for database: %s", database)
 
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query databases: %w", err)
+		err := s.backupDatabase(server, database)
+		if err != nil {
+			s.logger.Error("Failed to backup database %s: %v", database, err)
+			return 0, err
+		}
+
+		s.logger.Info("Successfully backed up database: %s", database)
 	}
-	defer rows.Close()
 
-	var databases []string
-	for rows.Next() {
-		var dbName string
-		err := rows.Scan(&dbName)
+	if server.DumpGlobals {
+		err := s.backupGlobals(server)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan database name: %w", err)
+			s.logger.Error("Failed to backup cluster globals: %v", err)
+			return 0, err
 		}
-		databases = append(databases, dbName)
+		s.logger.Info("Successfully backed up cluster globals")
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating database rows: %w", err)
+	return len(databases), nil
+}
+
+// Databases returns the databases that will be backed up for server: the
+// configured list, or every discovered database when the list is empty.
+func (s *Service) Databases(server config.Server) ([]string, error) {
+	if len(server.Databases) > 0 {
+		return server.Databases, nil
 	}
 
+	s.logger.Info("No specific databases configured for server %s, discovering all databases", server.Name)
+	databases, err := s.discoverDatabases(server)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("Discovered %d databases: %s", len(databases), strings.Join(databases, ", "))
 	return databases, nil
 }
 
-func (s *Service) backupDatabase(database string) error {
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	filename := fmt.Sprintf("%s_%s.sql.gz", database, timestamp)
+func (s *Service) backupDatabase(server config.Server, database string) error {
+	filename := objectName(server, KindDatabase, database, "sql.gz", time.Now())
 
-	cmd := exec.Command("pg_dump",
-		"-h", s.dbConfig.Database.Host,
-		"-p", fmt.Sprintf("%d", s.dbConfig.Database.Port),
-		"-U", s.dbConfig.Database.User,
+	args := []string{
+		"-h", server.Host,
+		"-p", fmt.Sprintf("%d", server.Port),
+		"-U", server.User,
 		"-d", database,
 		"--no-password",
-	)
-
-	if s.dbConfig.Database.Password != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%s", s.dbConfig.Database.Password))
 	}
+	options := dumpArgs(server.DumpOptionsFor(database))
+	if len(options) > 0 {
+		s.logger.Info("Using pg_dump options for database %s: %s", database, strings.Join(options, " "))
+		args = append(args, options...)
+	}
+
+	cmd := exec.Command("pg_dump", args...)
+	cmd.Env = toolEnv(server, database)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -161,78 +333,65 @@ func (s *Service) backupDatabase(database string) error {
 		s.logger.Warning("pg_dump warnings for database %s: %s", database, stderr.String())
 	}
 
-	var compressed bytes.Buffer
-	gzipWriter := gzip.NewWriter(&compressed)
-	_, err = gzipWriter.Write(stdout.Bytes())
-	if err != nil {
-		s.logger.Error("Failed to compress backup for database %s: %v", database, err)
-		return fmt.Errorf("failed to compress backup: %w", err)
-	}
-	err = gzipWriter.Close()
-	if err != nil {
-		s.logger.Error("Failed to close gzip writer for database %s: %v", database, err)
-		return fmt.Errorf("failed to close gzip writer: %w", err)
-	}
-
-	originalSize := stdout.Len()
-	compressedSize := compressed.Len()
-	compressionRatio := float64(compressedSize) / float64(originalSize) * 100
-
-	s.logger.Info("Backup compressed: %s (original: %d bytes, compressed: %d bytes, ratio: %.1f%%)",
-		filename, originalSize, compressedSize, compressionRatio)
-
-	s.logger.Info("Storing backup file: %s", filename)
-	err = s.storage.Store(filename, &compressed)
+	manifest, err := s.compressAndStore(filename, stdout.Bytes(), objectMetadata(server, KindDatabase, database, "sql.gz"))
 	if err != nil {
-		s.logger.Error("Failed to store backup for database %s: %v", database, err)
-		return fmt.Errorf("failed to store backup: %w", err)
+		return err
 	}
-
-	s.logger.Info("Backup stored successfully: %s (%d bytes compressed)", filename, compressedSize)
-	return nil
+	return s.storeManifest(manifest, server, KindDatabase, database, "pg_dump", options)
 }
 
-func (s *Service) backupFullServer() error {
-	timestamp := time.Now().Format("2006-01-02_15-04-05")
-	filename := fmt.Sprintf("full_dump_%s.sql.gz", timestamp)
-
-	// Check if pg_dumpall is available - try multiple locations
-	var pgDumpallPath string
-	possiblePaths := []string{
-		"pg_dumpall",
-		"/usr/bin/pg_dumpall",
-		"/usr/libexec/postgresql/pg_dumpall",
+// dumpArgs translates per-database dump options into pg_dump arguments.
+func dumpArgs(options config.DumpOptions) []string {
+	var args []string
+	for _, schema := range options.Schemas {
+		args = append(args, "--schema="+schema)
 	}
-
-	for _, path := range possiblePaths {
-		if _, err := exec.LookPath(path); err == nil {
-			pgDumpallPath = path
-			break
-		}
+	for _, schema := range options.ExcludeSchemas {
+		args = append(args, "--exclude-schema="+schema)
+	}
+	for _, table := range options.Tables {
+		args = append(args, "--table="+table)
 	}
+	for _, table := range options.ExcludeTables {
+		args = append(args, "--exclude-table="+table)
+	}
+	for _, table := range options.ExcludeTableData {
+		args = append(args, "--exclude-table-data="+table)
+	}
+	if options.NoOwner {
+		args = append(args, "--no-owner")
+	}
+	if options.NoPrivileges {
+		args = append(args, "--no-privileges")
+	}
+	if options.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+	if options.DataOnly {
+		args = append(args, "--data-only")
+	}
+	return args
+}
+
+func (s *Service) backupFullServer(server config.Server) error {
+	filename := objectName(server, KindFullDump, KindFullDump, "sql.gz", time.Now())
 
-	if pgDumpallPath == "" {
-		s.logger.Error("pg_dumpall not found in any expected location. Full dump requires PostgreSQL client tools to be installed.")
-		return fmt.Errorf("pg_dumpall not available")
+	pgDumpallPath, err := s.findPgDumpall()
+	if err != nil {
+		return err
 	}
 
 	s.logger.Info("Using pg_dumpall from: %s", pgDumpallPath)
 
 	// Use pg_dumpall to create a full cluster dump including all databases, roles, and tablespaces
 	cmd := exec.Command(pgDumpallPath,
-		"-h", s.dbConfig.Database.Host,
-		"-p", fmt.Sprintf("%d", s.dbConfig.Database.Port),
-		"-U", s.dbConfig.Database.User,
+		"-h", server.Host,
+		"-p", fmt.Sprintf("%d", server.Port),
+		"-U", server.User,
 		"--no-password",
 	)
 
-	if s.dbConfig.Database.Password != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("PGPASSWORD=%s", s.dbConfig.Database.Password))
-		// Also add the current environment to ensure PATH is preserved
-		cmd.Env = append(cmd.Env, "PATH=/usr/libexec/postgresql:/usr/bin:/usr/sbin:/bin:/sbin")
-	} else {
-		cmd.Env = []string{"PATH=/usr/libexec/postgresql:/usr/bin:/usr/sbin:/bin:/sbin"}
-	}
+	cmd.Env = toolEnv(server, "postgres")
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -241,7 +400,7 @@ func (s *Service) backupFullServer() error {
 	s.logger.Info("Executing pg_dumpall for full server dump")
 	start := time.Now()
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		s.logger.Error("pg_dumpall failed: %v, stderr: %s", err, stderr.String())
 		s.logger.Error("This might indicate missing PostgreSQL client tools or insufficient permissions")
@@ -256,33 +415,158 @@ func (s *Service) backupFullServer() error {
 		s.logger.Warning("pg_dumpall warnings: %s", stderr.String())
 	}
 
+	manifest, err := s.compressAndStore(filename, stdout.Bytes(), objectMetadata(server, KindFullDump, "", "sql.gz"))
+	if err != nil {
+		return err
+	}
+	return s.storeManifest(manifest, server, KindFullDump, "", pgDumpallPath, nil)
+}
+
+// findPgDumpall locates pg_dumpall, which some distributions install outside
+// the PATH.
+func (s *Service) findPgDumpall() (string, error) {
+	possiblePaths := []string{
+		"pg_dumpall",
+		"/usr/bin/pg_dumpall",
+		"/usr/libexec/postgresql/pg_dumpall",
+	}
+
+	for _, path := range possiblePaths {
+		if _, err := exec.LookPath(path); err == nil {
+			return path, nil
+		}
+	}
+
+	s.logger.Error("pg_dumpall not found in any expected location. Full dump requires PostgreSQL client tools to be installed.")
+	return "", fmt.Errorf("pg_dumpall not available")
+}
+
+// storeStream runs cmd and streams its stdout through gzip to the storage
+// provider, returning a manifest with the sizes and checksum of what was
+// stored. outputDone must be closed once everything the caller reads from
+// the command's stderr has been consumed. If the command fails the stream
+// is closed with an error, so the provider does not keep a truncated
+// backup.
+func (s *Service) storeStream(filename string, cmd *exec.Cmd, outputDone <-chan struct{}, metadata storage.Metadata) (*Manifest, error) {
+	name := filepath.Base(cmd.Path)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture %s output: %w", name, err)
+	}
+	if err := cmd.Start(); err != nil {
+		// Start closes the command's pipes, so the caller's stderr reader
+		// finishes; wait for it before the caller reads what it collected.
+		<-outputDone
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	raw := &countingReader{reader: stdout}
+	pipeReader, pipeWriter := io.Pipe()
+	commandDone := make(chan error, 1)
+	go func() {
+		gzipWriter := gzip.NewWriter(pipeWriter)
+		_, err := io.Copy(gzipWriter, raw)
+		if err == nil {
+			err = gzipWriter.Close()
+		}
+		<-outputDone
+		if waitErr := cmd.Wait(); waitErr != nil {
+			err = fmt.Errorf("%s failed: %w", name, waitErr)
+			commandDone <- err
+		} else {
+			commandDone <- nil
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	hash := sha256.New()
+	compressed := &countingReader{reader: io.TeeReader(pipeReader, hash)}
+	storeErr := storage.StoreWithMetadata(s.storage, filename, compressed, metadata)
+	if storeErr != nil {
+		pipeReader.CloseWithError(storeErr)
+		cmd.Process.Kill()
+	}
+	commandErr := <-commandDone
+
+	// A failing command is the root cause of whatever the provider saw,
+	// unless the command was only killed because storing failed.
+	if commandErr != nil && (storeErr == nil || errors.Is(storeErr, commandErr)) {
+		return nil, commandErr
+	}
+	if storeErr != nil {
+		return nil, fmt.Errorf("failed to store backup: %w", storeErr)
+	}
+	return &Manifest{
+		Artifact:       filename,
+		SHA256:         hex.EncodeToString(hash.Sum(nil)),
+		RawSize:        raw.count,
+		CompressedSize: compressed.count,
+	}, nil
+}
+
+// objectMetadata describes a backup to providers that keep metadata with
+// the stored objects.
+func objectMetadata(server config.Server, kind, database, format string) storage.Metadata {
+	metadata := storage.Metadata{
+		"server":     server.Name,
+		"kind":       kind,
+		"format":     format,
+		"created-at": time.Now().UTC().Format(time.RFC3339),
+	}
+	if database != "" {
+		metadata["database"] = database
+	}
+	return metadata
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// compressAndStore gzips a dump and writes it to the storage provider,
+// returning a manifest with the sizes and checksum of what was stored.
+func (s *Service) compressAndStore(filename string, dump []byte, metadata storage.Metadata) (*Manifest, error) {
 	var compressed bytes.Buffer
 	gzipWriter := gzip.NewWriter(&compressed)
-	_, err = gzipWriter.Write(stdout.Bytes())
+	_, err := gzipWriter.Write(dump)
 	if err != nil {
-		s.logger.Error("Failed to compress full dump: %v", err)
-		return fmt.Errorf("failed to compress full dump: %w", err)
+		s.logger.Error("Failed to compress %s: %v", filename, err)
+		return nil, fmt.Errorf("failed to compress backup: %w", err)
 	}
 	err = gzipWriter.Close()
 	if err != nil {
-		s.logger.Error("Failed to close gzip writer for full dump: %v", err)
-		return fmt.Errorf("failed to close gzip writer: %w", err)
+		s.logger.Error("Failed to close gzip writer for %s: %v", filename, err)
+		return nil, fmt.Errorf("failed to close gzip writer: %w", err)
 	}
 
-	originalSize := stdout.Len()
+	originalSize := len(dump)
 	compressedSize := compressed.Len()
+	checksum := sha256.Sum256(compressed.Bytes())
 	compressionRatio := float64(compressedSize) / float64(originalSize) * 100
 
-	s.logger.Info("Full dump compressed: %s (original: %d bytes, compressed: %d bytes, ratio: %.1f%%)",
+	s.logger.Info("Backup compressed: %s (original: %d bytes, compressed: %d bytes, ratio: %.1f%%)",
 		filename, originalSize, compressedSize, compressionRatio)
 
-	s.logger.Info("Storing full dump file: %s", filename)
-	err = s.storage.Store(filename, &compressed)
+	s.logger.Info("Storing backup file: %s", filename)
+	err = storage.StoreWithMetadata(s.storage, filename, &compressed, metadata)
 	if err != nil {
-		s.logger.Error("Failed to store full dump: %v", err)
-		return fmt.Errorf("failed to store full dump: %w", err)
+		s.logger.Error("Failed to store %s: %v", filename, err)
+		return nil, fmt.Errorf("failed to store backup: %w", err)
 	}
 
-	s.logger.Info("Full dump stored successfully: %s (%d bytes compressed)", filename, compressedSize)
-	return nil
+	s.logger.Info("Backup stored successfully: %s (%d bytes compressed)", filename, compressedSize)
+	return &Manifest{
+		Artifact:       filename,
+		SHA256:         hex.EncodeToString(checksum[:]),
+		RawSize:        int64(originalSize),
+		CompressedSize: int64(compressedSize),
+	}, nil
 }
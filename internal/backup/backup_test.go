@@ -0,0 +1,48 @@
+package backup
+
+import (
+	"path/filepath"
+	"testing"
+
+	"pg-backup/internal/config"
+	"pg-backup/internal/logger"
+	"pg-backup/internal/storage"
+)
+
+// closeCounter is a provider that records how often it is closed.
+type closeCounter struct {
+	storage.Provider
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestReloadClosesReplacedProvider(t *testing.T) {
+	dir := t.TempDir()
+	log := logger.New(filepath.Join(dir, "backup.log"))
+	first := &closeCounter{Provider: storage.NewLocal(storage.LocalOptions{Path: dir})}
+	second := &closeCounter{Provider: storage.NewLocal(storage.LocalOptions{Path: dir})}
+	third := &closeCounter{Provider: storage.NewLocal(storage.LocalOptions{Path: dir})}
+	s := NewService(&config.Config{}, first, log)
+
+	job := s.snapshot()
+	s.Reload(&config.Config{}, second)
+	if first.closed != 0 {
+		t.Fatalf("provider closed while a run was still using it")
+	}
+	job.release()
+	if first.closed != 1 {
+		t.Errorf("replaced provider closed %d times after the run finished, want 1", first.closed)
+	}
+
+	s.Reload(&config.Config{}, third)
+	if second.closed != 1 {
+		t.Errorf("idle replaced provider closed %d times, want 1", second.closed)
+	}
+	if third.closed != 0 {
+		t.Errorf("current provider closed %d times, want 0", third.closed)
+	}
+}
@@ -0,0 +1,236 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"pg-backup/internal/catalog"
+	"pg-backup/internal/config"
+	"pg-backup/internal/storage"
+)
+
+// catalogReaders bounds how many manifests and verification results
+// Catalog reads at once.
+const catalogReaders = 8
+
+// Catalog lists the stored backups selected by filter, oldest first, with
+// the details recorded in their manifests and verification results.
+func (s *Service) Catalog(filter catalog.Filter) ([]catalog.Entry, error) {
+	job := s.snapshot()
+	defer job.release()
+
+	servers := job.dbConfig.ServerList()
+	if filter.Server != "" {
+		server, err := job.server(filter.Server)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s", catalog.ErrUnknownServer, filter.Server)
+		}
+		servers = []config.Server{server}
+	}
+
+	entries := []catalog.Entry{}
+	sidecars := make(map[string]storage.Object)
+	for _, server := range servers {
+		objects, err := job.storage.List(newNamePattern(server).listPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: failed to list backups: %w", server.Name, err)
+		}
+
+		for _, object := range objects {
+			if strings.HasSuffix(object.Name, ManifestSuffix) || strings.HasSuffix(object.Name, VerificationSuffix) {
+				sidecars[object.Name] = object
+			}
+		}
+
+		for _, a := range findArtifacts(server, objects) {
+			if entry := newEntry(server, a); filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	if filter.Server == "" {
+		job.sidecars.retain(sidecars)
+	}
+
+	// Object stores answer each read in tens of milliseconds, so the
+	// sidecars are read several at a time.
+	errs := make([]error, len(entries))
+	slots := make(chan struct{}, catalogReaders)
+	var wg sync.WaitGroup
+	for i := range entries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer func() { <-slots; wg.Done() }()
+			errs[i] = job.describe(&entries[i], sidecars)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Inspect returns the catalog entry of the backup called name, given in
+// full or without the naming prefix or server folder. serverName may be
+// empty to search every server.
+func (s *Service) Inspect(serverName, name string) (*catalog.Entry, error) {
+	job := s.snapshot()
+	defer job.release()
+
+	servers := job.dbConfig.ServerList()
+	if serverName != "" {
+		server, err := job.server(serverName)
+		if err != nil {
+			return nil, err
+		}
+		servers = []config.Server{server}
+	}
+
+	for _, server := range servers {
+		artifacts, err := job.listArtifacts(server)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: failed to list backups: %w", server.Name, err)
+		}
+		for _, a := range artifacts {
+			if !isNamed(server, a, name) {
+				continue
+			}
+			entry := newEntry(server, a)
+			if err := job.describe(&entry, nil); err != nil {
+				return nil, err
+			}
+			return &entry, nil
+		}
+	}
+	return nil, fmt.Errorf("backup %s not found", name)
+}
+
+func newEntry(server config.Server, a artifact) catalog.Entry {
+	entry := catalog.Entry{
+		Name:   a.name,
+		Server: server.Name,
+		Kind:   a.kind,
+		Time:   a.time,
+		Size:   a.size,
+	}
+	if a.kind == KindDatabase {
+		entry.Database = a.key
+	}
+	return entry
+}
+
+// describe fills in an entry from its manifest and verification result.
+// When sidecars is not nil only the files it lists are read, which saves a
+// request per missing file on object stores, and they are read through the
+// sidecar cache.
+func (s *Service) describe(entry *catalog.Entry, sidecars map[string]storage.Object) error {
+	manifestObject, listed := sidecars[entry.Name+ManifestSuffix]
+	if sidecars == nil || listed {
+		manifest, err := readCached(s.sidecars, manifestObject, listed, s.readManifest, entry.Name)
+		switch {
+		case err == nil:
+			entry.HasManifest = true
+			entry.SHA256 = manifest.SHA256
+			entry.RawSize = manifest.RawSize
+			entry.ToolVersion = manifest.ToolVersion
+			entry.ServerVersion = manifest.ServerVersion
+			entry.Options = manifest.Options
+		case !errors.Is(err, storage.ErrNotFound):
+			return err
+		}
+	}
+
+	verificationObject, listed := sidecars[entry.Name+VerificationSuffix]
+	if sidecars == nil || listed {
+		result, err := readCached(s.sidecars, verificationObject, listed, s.readVerification, entry.Name)
+		switch {
+		case err == nil:
+			entry.Verification = &catalog.Verification{
+				VerifiedAt: result.VerifiedAt,
+				Success:    result.Success,
+				Error:      result.Error,
+				Tables:     result.Tables,
+			}
+		case !errors.Is(err, storage.ErrNotFound):
+			return err
+		}
+	}
+	return nil
+}
+
+// sidecarCache keeps the manifests and verification results read for the
+// catalog. An entry is used only while the listed size and modification
+// time of its file are unchanged, so a new verification result is read
+// again.
+type sidecarCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedSidecar
+}
+
+type cachedSidecar struct {
+	object storage.Object
+	value  interface{}
+}
+
+func newSidecarCache() *sidecarCache {
+	return &sidecarCache{entries: make(map[string]cachedSidecar)}
+}
+
+// retain drops the entries of files that are no longer listed.
+func (c *sidecarCache) retain(listed map[string]storage.Object) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.entries {
+		if _, ok := listed[name]; !ok {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// readCached returns what read returns for the backup name, taking it from
+// cache when object, the listing entry of the sidecar, is known and
+// unchanged.
+func readCached[T any](cache *sidecarCache, object storage.Object, listed bool, read func(string) (*T, error), name string) (*T, error) {
+	if !listed || cache == nil {
+		return read(name)
+	}
+
+	cache.mu.Lock()
+	cached, ok := cache.entries[object.Name]
+	cache.mu.Unlock()
+	if ok && cached.object.Size == object.Size && cached.object.ModTime.Equal(object.ModTime) {
+		return cached.value.(*T), nil
+	}
+
+	value, err := read(name)
+	if err != nil {
+		return nil, err
+	}
+	cache.mu.Lock()
+	cache.entries[object.Name] = cachedSidecar{object: object, value: value}
+	cache.mu.Unlock()
+	return value, nil
+}
+
+// readVerification loads the verification result stored next to a backup.
+func (s *Service) readVerification(name string) (*VerificationResult, error) {
+	reader, err := s.storage.Open(name + VerificationSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var result VerificationResult
+	if err := json.NewDecoder(reader).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", name+VerificationSuffix, err)
+	}
+	return &result, nil
+}
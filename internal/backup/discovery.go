@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+
+	"pg-backup/internal/config"
+)
+
+type discoveredDatabase struct {
+	name  string
+	owner string
+	size  sql.NullInt64
+}
+
+func (s *Service) discoverDatabases(server config.Server) ([]string, error) {
+	filter, err := newDiscoveryFilter(server.Discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openDB(server, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// The size is only readable for databases we may connect to; it is left
+	// NULL for the others rather than failing the whole query.
+	query := `
+		SELECT d.datname,
+		       pg_get_userbyid(d.datdba),
+		       CASE WHEN has_database_privilege(d.oid, 'CONNECT')
+		            THEN pg_database_size(d.oid) END
+		FROM pg_database d
+		WHERE d.datistemplate = false
+		AND d.datallowconn
+		ORDER BY d.datname
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %w", err)
+	}
+	defer rows.Close()
+
+	var databases []string
+	for rows.Next() {
+		var candidate discoveredDatabase
+		err := rows.Scan(&candidate.name, &candidate.owner, &candidate.size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan database name: %w", err)
+		}
+
+		if config.IsReservedDatabaseName(candidate.name) {
+			s.logger.Warning("Skipping database %s: its backups would be taken for the server's %s backups", candidate.name, candidate.name)
+			continue
+		}
+		if reason := filter.skipReason(candidate); reason != "" {
+			if candidate.name != "postgres" || server.Discovery.IncludePostgres {
+				s.logger.Info("Skipping database %s: %s", candidate.name, reason)
+			}
+			continue
+		}
+		databases = append(databases, candidate.name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating database rows: %w", err)
+	}
+
+	return databases, nil
+}
+
+type discoveryFilter struct {
+	config  config.Discovery
+	include []func(string) bool
+	exclude []func(string) bool
+	owners  map[string]bool
+	minSize int64
+	maxSize int64
+}
+
+func newDiscoveryFilter(discovery config.Discovery) (*discoveryFilter, error) {
+	filter := &discoveryFilter{config: discovery}
+
+	for _, pattern := range discovery.Include {
+		match, err := config.CompilePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+		}
+		filter.include = append(filter.include, match)
+	}
+	for _, pattern := range discovery.Exclude {
+		match, err := config.CompilePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+		filter.exclude = append(filter.exclude, match)
+	}
+
+	if len(discovery.Owners) > 0 {
+		filter.owners = make(map[string]bool)
+		for _, owner := range discovery.Owners {
+			filter.owners[owner] = true
+		}
+	}
+
+	var err error
+	if filter.minSize, err = config.ParseSize(discovery.MinSize); err != nil {
+		return nil, err
+	}
+	if filter.maxSize, err = config.ParseSize(discovery.MaxSize); err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// skipReason explains why a database is left out, or returns "" when it
+// should be backed up.
+func (f *discoveryFilter) skipReason(db discoveredDatabase) string {
+	if db.name == "postgres" && !f.config.IncludePostgres {
+		return "maintenance database (set include_postgres to back it up)"
+	}
+	if len(f.include) > 0 && !matchesAny(f.include, db.name) {
+		return "not matched by any include pattern"
+	}
+	if matchesAny(f.exclude, db.name) {
+		return "matched by an exclude pattern"
+	}
+	if f.owners != nil && !f.owners[db.owner] {
+		return fmt.Sprintf("owner %s is not listed in owners", db.owner)
+	}
+	if f.minSize > 0 || f.maxSize > 0 {
+		if !db.size.Valid {
+			return "size unknown (no CONNECT privilege)"
+		}
+		if db.size.Int64 < f.minSize {
+			return fmt.Sprintf("size %d bytes is below min_size", db.size.Int64)
+		}
+		if f.maxSize > 0 && db.size.Int64 > f.maxSize {
+			return fmt.Sprintf("size %d bytes is above max_size", db.size.Int64)
+		}
+	}
+	return ""
+}
+
+func matchesAny(matchers []func(string) bool, name string) bool {
+	for _, match := range matchers {
+		if match(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"pg-backup/internal/config"
+)
+
+// backupGlobals stores the cluster-wide objects (roles, tablespaces and
+// their grants) that per-database pg_dump files do not contain, so those
+// dumps can be restored onto a fresh server.
+func (s *Service) backupGlobals(server config.Server) error {
+	filename := objectName(server, KindGlobals, KindGlobals, "sql.gz", time.Now())
+
+	pgDumpallPath, err := s.findPgDumpall()
+	if err != nil {
+		return err
+	}
+
+	options := []string{"--globals-only"}
+	if server.NoRolePasswords {
+		options = append(options, "--no-role-passwords")
+	}
+	args := []string{
+		"-h", server.Host,
+		"-p", fmt.Sprintf("%d", server.Port),
+		"-U", server.User,
+		"--no-password",
+	}
+
+	cmd := exec.Command(pgDumpallPath, append(args, options...)...)
+	cmd.Env = toolEnv(server, "postgres")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	s.logger.Info("Executing pg_dumpall --globals-only for server %s", server.Name)
+	start := time.Now()
+
+	err = cmd.Run()
+	if err != nil {
+		s.logger.Error("pg_dumpall --globals-only failed: %v, stderr: %s", err, stderr.String())
+		return fmt.Errorf("pg_dumpall --globals-only failed: %w", err)
+	}
+
+	s.logger.Info("pg_dumpall --globals-only completed in %v", time.Since(start))
+
+	if stderr.Len() > 0 {
+		s.logger.Warning("pg_dumpall --globals-only warnings: %s", stderr.String())
+	}
+
+	manifest, err := s.compressAndStore(filename, stdout.Bytes(), objectMetadata(server, KindGlobals, "", "sql.gz"))
+	if err != nil {
+		return err
+	}
+	return s.storeManifest(manifest, server, KindGlobals, "", pgDumpallPath, options)
+}
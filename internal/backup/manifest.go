@@ -0,0 +1,203 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"pg-backup/internal/config"
+	"pg-backup/internal/storage"
+)
+
+// ManifestSuffix is appended to a backup name to get the name of its
+// manifest.
+const ManifestSuffix = ".manifest.json"
+
+// Manifest records what was written for one backup so that the stored
+// object can later be checked for corruption.
+type Manifest struct {
+	Artifact       string    `json:"artifact"`
+	Server         string    `json:"server"`
+	Database       string    `json:"database,omitempty"`
+	Kind           string    `json:"kind"`
+	CreatedAt      time.Time `json:"created_at"`
+	SHA256         string    `json:"sha256"`
+	RawSize        int64     `json:"raw_size"`
+	CompressedSize int64     `json:"compressed_size"`
+	ToolVersion    string    `json:"tool_version,omitempty"`
+	ServerVersion  string    `json:"server_version,omitempty"`
+	Options        []string  `json:"options,omitempty"`
+}
+
+// storeManifest completes manifest with the details of the backup run and
+// stores it next to the backup.
+func (s *Service) storeManifest(manifest *Manifest, server config.Server, kind, database, tool string, options []string) error {
+	manifest.Server = server.Name
+	manifest.Kind = kind
+	manifest.Database = database
+	manifest.CreatedAt = time.Now()
+	manifest.ToolVersion = toolVersion(tool)
+	manifest.ServerVersion = s.serverVersion(server, database)
+	manifest.Options = options
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := s.storage.Store(manifest.Artifact+ManifestSuffix, bytes.NewReader(data)); err != nil {
+		s.logger.Error("Failed to store manifest for %s: %v", manifest.Artifact, err)
+		return fmt.Errorf("failed to store manifest: %w", err)
+	}
+	return nil
+}
+
+// readManifest loads the manifest stored next to a backup.
+func (s *Service) readManifest(name string) (*Manifest, error) {
+	reader, err := s.storage.Open(name + ManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", name+ManifestSuffix, err)
+	}
+	return &manifest, nil
+}
+
+// toolVersion returns the --version output of a PostgreSQL client tool, or
+// "" if it cannot be run.
+func toolVersion(tool string) string {
+	cmd := exec.Command(tool, "--version")
+	cmd.Env = baseToolEnv()
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// serverVersion returns the version reported by the server. A failure only
+// leaves the manifest field empty.
+func (s *Service) serverVersion(server config.Server, database string) string {
+	if database == "" {
+		database = "postgres"
+	}
+	db, err := openDB(server, database)
+	if err != nil {
+		s.logger.Warning("Could not read server version of %s: %v", server.Name, err)
+		return ""
+	}
+	defer db.Close()
+
+	var version string
+	if err := db.QueryRow("SHOW server_version").Scan(&version); err != nil {
+		s.logger.Warning("Could not read server version of %s: %v", server.Name, err)
+		return ""
+	}
+	return version
+}
+
+// Outcomes of checking a backup against its manifest.
+const (
+	CheckOK              = "ok"
+	CheckMissingManifest = "no manifest"
+	CheckFailed          = "failed"
+)
+
+// CheckResult is the outcome of checking one backup on one destination.
+type CheckResult struct {
+	Server      string
+	Destination string
+	Artifact    string
+	Status      string
+	Error       string
+}
+
+// Check downloads every backup of the named server, or of every server when
+// serverName is empty, and compares its size and SHA-256 with its manifest.
+// Every destination is checked on its own, so a copy missing or damaged on
+// one of them is reported. Backups stored before manifests existed are
+// reported but do not fail the check.
+func (s *Service) Check(serverName string) ([]CheckResult, error) {
+	job := s.snapshot()
+	defer job.release()
+
+	servers := job.dbConfig.ServerList()
+	if serverName != "" {
+		server, err := job.server(serverName)
+		if err != nil {
+			return nil, err
+		}
+		servers = []config.Server{server}
+	}
+
+	var results []CheckResult
+	failed := 0
+	for _, server := range servers {
+		for _, destination := range job.destinations() {
+			artifacts, err := destination.job.listArtifacts(server)
+			if err != nil {
+				return results, fmt.Errorf("server %s: destination %s: failed to list backups: %w", server.Name, destination.name, err)
+			}
+
+			for _, a := range artifacts {
+				result := CheckResult{Server: server.Name, Destination: destination.name, Artifact: a.name, Status: CheckOK}
+				if err := destination.job.checkArtifact(a); errors.Is(err, storage.ErrNotFound) {
+					result.Status = CheckMissingManifest
+				} else if err != nil {
+					result.Status = CheckFailed
+					result.Error = err.Error()
+					failed++
+					job.logger.Error("Check of %s%s failed: %v", a.name, job.onDestination(destination.name), err)
+				}
+				results = append(results, result)
+			}
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d backups failed the check", failed, len(results))
+	}
+	return results, nil
+}
+
+// checkArtifact re-hashes a stored backup. It returns storage.ErrNotFound
+// when the backup has no manifest.
+func (s *Service) checkArtifact(a artifact) error {
+	manifest, err := s.readManifest(a.name)
+	if err != nil {
+		return err
+	}
+
+	reader, err := s.storage.Open(a.name)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("backup disappeared during the check")
+		}
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, reader)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	if size != manifest.CompressedSize {
+		return fmt.Errorf("size is %d bytes, manifest says %d", size, manifest.CompressedSize)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != manifest.SHA256 {
+		return fmt.Errorf("SHA-256 is %s, manifest says %s", sum, manifest.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"pg-backup/internal/config"
+)
+
+var namePlaceholder = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// placeholderPatterns match the values each naming placeholder takes.
+// None of them matches a "/", so a name cannot be split across folders in
+// more than one way.
+var placeholderPatterns = map[string]string{
+	"database":  `[^/]+`,
+	"kind":      `database|full_dump|globals|basebackup`,
+	"timestamp": `\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2}`,
+	"yyyy":      `\d{4}`,
+	"mm":        `\d{2}`,
+	"dd":        `\d{2}`,
+	"ext":       `sql\.gz|tar\.gz`,
+}
+
+// nameLocation returns the time zone server's backup names are written in.
+func nameLocation(server config.Server) *time.Location {
+	if server.Naming.TimeZone == config.TimeZoneUTC {
+		return time.UTC
+	}
+	return time.Local
+}
+
+// objectName returns the name a backup of server taken at t is stored
+// under. key is the database name, or the kind for server-wide backups.
+func objectName(server config.Server, kind, key, ext string, t time.Time) string {
+	t = t.In(nameLocation(server))
+	values := map[string]string{
+		"server":    server.Name,
+		"database":  key,
+		"kind":      kind,
+		"timestamp": t.Format(timestampFormat),
+		"yyyy":      t.Format("2006"),
+		"mm":        t.Format("01"),
+		"dd":        t.Format("02"),
+		"ext":       ext,
+	}
+	return server.Naming.Prefix + namePlaceholder.ReplaceAllStringFunc(server.Naming.Template, func(placeholder string) string {
+		return values[strings.Trim(placeholder, "{}")]
+	})
+}
+
+// namePattern recognises the names objectName produces for one server.
+type namePattern struct {
+	server config.Server
+	// listPrefix is the folder all of the server's backups are stored
+	// under: the part of the template before the first placeholder other
+	// than {server}, up to its last "/".
+	listPrefix string
+	regexp     *regexp.Regexp
+	// fields names the placeholder captured by each group of regexp.
+	fields []string
+}
+
+func newNamePattern(server config.Server) *namePattern {
+	p := &namePattern{server: server}
+	template := server.Naming.Template
+
+	var pattern strings.Builder
+	pattern.WriteString("^" + regexp.QuoteMeta(server.Naming.Prefix))
+	literal := server.Naming.Prefix
+	inLiteral := true
+	last := 0
+	for _, match := range namePlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		text := template[last:match[0]]
+		name := template[match[2]:match[3]]
+		last = match[1]
+
+		pattern.WriteString(regexp.QuoteMeta(text))
+		if inLiteral {
+			literal += text
+		}
+		if name == "server" {
+			pattern.WriteString(regexp.QuoteMeta(server.Name))
+			if inLiteral {
+				literal += server.Name
+			}
+			continue
+		}
+		inLiteral = false
+		pattern.WriteString("(" + placeholderPatterns[name] + ")")
+		p.fields = append(p.fields, name)
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]) + "$")
+
+	p.listPrefix = literal[:strings.LastIndex(literal, "/")+1]
+	p.regexp = regexp.MustCompile(pattern.String())
+	return p
+}
+
+// parse recognises a backup of the server. Names are rendered again from
+// the values found, so one whose repeated placeholders or date folders
+// disagree with its timestamp is not taken for a backup.
+func (p *namePattern) parse(name string) (artifact, bool) {
+	match := p.regexp.FindStringSubmatch(name)
+	if match == nil {
+		return artifact{}, false
+	}
+	values := make(map[string]string)
+	for i, field := range p.fields {
+		values[field] = match[i+1]
+	}
+
+	timestamp, err := time.ParseInLocation(timestampFormat, values["timestamp"], nameLocation(p.server))
+	if err != nil {
+		return artifact{}, false
+	}
+
+	a := artifact{name: name, key: values["database"], kind: values["kind"], time: timestamp}
+	if a.kind == "" {
+		switch {
+		case values["ext"] == "tar.gz" && a.key == "basebackup":
+			a.kind = KindBaseBackup
+		case a.key == "full_dump":
+			a.kind = KindFullDump
+		case a.key == "globals":
+			a.kind = KindGlobals
+		default:
+			a.kind = KindDatabase
+		}
+	}
+
+	if objectName(p.server, a.kind, a.key, values["ext"], timestamp) != name {
+		return artifact{}, false
+	}
+	return a, true
+}
+
+// isNamed reports whether a is the backup a user called name: its full
+// object name, or the name without the naming prefix or server folder.
+func isNamed(server config.Server, a artifact, name string) bool {
+	return a.name == name || a.name == server.Naming.Prefix+name || a.name == server.Prefix+name
+}
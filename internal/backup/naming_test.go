@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"pg-backup/internal/config"
+)
+
+func TestNamingRoundTrip(t *testing.T) {
+	templates := []struct {
+		name     string
+		naming   config.Naming
+		wantName string
+	}{
+		{"default", config.Naming{Template: "{database}_{timestamp}.{ext}"}, "app_2024-01-31_02-00-00.sql.gz"},
+		{"server folder", config.Naming{Template: "{server}/{database}_{timestamp}.{ext}", Prefix: "pg/"}, "pg/main/app_2024-01-31_02-00-00.sql.gz"},
+		{"date folders", config.Naming{Template: "{server}/{kind}/{database}/{yyyy}/{mm}/{dd}/{database}_{timestamp}.{ext}", TimeZone: config.TimeZoneUTC},
+			"main/database/app/2024/01/31/app_2024-01-31_02-00-00.sql.gz"},
+		{"dash separator", config.Naming{Template: "{yyyy}/{mm}/{database}-{timestamp}.{ext}"}, "2024/01/app-2024-01-31_02-00-00.sql.gz"},
+	}
+	backups := []struct {
+		kind, key, ext string
+	}{
+		{KindDatabase, "app", "sql.gz"},
+		{KindDatabase, "my_app-2", "sql.gz"},
+		{KindFullDump, "full_dump", "sql.gz"},
+		{KindGlobals, "globals", "sql.gz"},
+		{KindBaseBackup, "basebackup", "tar.gz"},
+	}
+
+	for _, tt := range templates {
+		t.Run(tt.name, func(t *testing.T) {
+			server := config.Server{Name: "main", Naming: tt.naming}
+			location := nameLocation(server)
+			taken := time.Date(2024, 1, 31, 2, 0, 0, 0, location)
+			pattern := newNamePattern(server)
+
+			if got := objectName(server, KindDatabase, "app", "sql.gz", taken); got != tt.wantName {
+				t.Errorf("objectName = %q, want %q", got, tt.wantName)
+			}
+			for _, backup := range backups {
+				name := objectName(server, backup.kind, backup.key, backup.ext, taken)
+				if !strings.HasPrefix(name, pattern.listPrefix) {
+					t.Errorf("%s is not below the list prefix %q", name, pattern.listPrefix)
+				}
+				a, ok := pattern.parse(name)
+				if !ok {
+					t.Errorf("%s was not recognised", name)
+					continue
+				}
+				if a.name != name || a.kind != backup.kind || a.key != backup.key || !a.time.Equal(taken) {
+					t.Errorf("%s parsed as %+v", name, a)
+				}
+			}
+		})
+	}
+}
+
+func TestNamingRejects(t *testing.T) {
+	server := config.Server{Name: "main", Naming: config.Naming{
+		Template: "{server}/{yyyy}/{mm}/{database}_{timestamp}.{ext}",
+		TimeZone: config.TimeZoneUTC,
+	}}
+	pattern := newNamePattern(server)
+
+	tests := []struct {
+		name   string
+		object string
+	}{
+		{"month folder disagrees", "main/2024/02/app_2024-01-31_02-00-00.sql.gz"},
+		{"other server", "main_eu/2024/01/app_2024-01-31_02-00-00.sql.gz"},
+		{"sidecar", "main/2024/01/app_2024-01-31_02-00-00.sql.gz" + ManifestSuffix},
+		{"invalid date", "main/2024/13/app_2024-13-31_02-00-00.sql.gz"},
+		{"unknown extension", "main/2024/01/app_2024-01-31_02-00-00.dump"},
+		{"missing folder", "main/app_2024-01-31_02-00-00.sql.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, ok := pattern.parse(tt.object); ok {
+				t.Errorf("%s parsed as %+v", tt.object, a)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"pg-backup/internal/config"
+)
+
+// PhysicalInfo describes a base backup. It is stored as JSON next to the
+// archive (<archive>.info.json) and is what point-in-time restore uses to
+// pick a base backup and the WAL it needs.
+type PhysicalInfo struct {
+	Server    string    `json:"server"`
+	Archive   string    `json:"archive"`
+	StartLSN  string    `json:"start_lsn"`
+	StopLSN   string    `json:"stop_lsn"`
+	Timeline  int       `json:"timeline"`
+	StartTime time.Time `json:"start_time"`
+	StopTime  time.Time `json:"stop_time"`
+}
+
+// InfoSuffix is appended to a base backup archive name to get the name of
+// its PhysicalInfo file.
+const InfoSuffix = ".info.json"
+
+var (
+	walStartPattern = regexp.MustCompile(`write-ahead log start point: ([0-9A-Fa-f]+/[0-9A-Fa-f]+) on timeline (\d+)`)
+	walEndPattern   = regexp.MustCompile(`write-ahead log end point: ([0-9A-Fa-f]+/[0-9A-Fa-f]+)`)
+)
+
+// progressInterval limits how often pg_basebackup progress is logged.
+const progressInterval = 30 * time.Second
+
+// backupPhysical takes a base backup of the whole cluster with
+// pg_basebackup. The tar stream (with the WAL needed for consistency
+// included) is compressed and streamed to storage without touching local
+// disk, so the cluster may be larger than the backup host's memory.
+func (s *Service) backupPhysical(server config.Server) error {
+	now := time.Now()
+	filename := objectName(server, KindBaseBackup, KindBaseBackup, "tar.gz", now)
+
+	// Writing a tar to stdout requires WAL to be fetched at the end rather
+	// than streamed in parallel, and only works without extra tablespaces.
+	options := []string{"-D", "-", "-F", "tar", "-X", "fetch"}
+	cmd := exec.Command("pg_basebackup", append([]string{
+		"-h", server.Host,
+		"-p", fmt.Sprintf("%d", server.Port),
+		"-U", server.User,
+		"--no-password",
+		"--progress",
+		"--verbose",
+		"--label", "pg-backup " + now.Format(timestampFormat),
+	}, options...)...)
+	cmd.Env = toolEnv(server, "replication")
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture pg_basebackup output: %w", err)
+	}
+
+	info := PhysicalInfo{
+		Server:    server.Name,
+		Archive:   filename,
+		StartTime: time.Now(),
+	}
+
+	s.logger.Info("Executing pg_basebackup for server %s", server.Name)
+
+	var messages bytes.Buffer
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		s.readBasebackupOutput(stderr, &info, &messages)
+	}()
+
+	manifest, err := s.storeStream(filename, cmd, stderrDone, objectMetadata(server, KindBaseBackup, "", "tar.gz"))
+	if err != nil {
+		s.logger.Error("pg_basebackup failed for server %s: %v, output: %s", server.Name, err, messages.String())
+		return err
+	}
+	info.StopTime = time.Now()
+
+	s.logger.Info("Base backup stored: %s (original: %d bytes, compressed: %d bytes) in %v",
+		filename, manifest.RawSize, manifest.CompressedSize, info.StopTime.Sub(info.StartTime))
+	s.logger.Info("Base backup WAL range: start %s, stop %s, timeline %d", info.StartLSN, info.StopLSN, info.Timeline)
+
+	if info.StartLSN == "" || info.StopLSN == "" {
+		s.logger.Warning("Could not determine WAL positions from pg_basebackup output: %s", messages.String())
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode base backup info: %w", err)
+	}
+	if err := s.storage.Store(filename+InfoSuffix, bytes.NewReader(data)); err != nil {
+		s.logger.Error("Failed to store base backup info for %s: %v", filename, err)
+		return fmt.Errorf("failed to store base backup info: %w", err)
+	}
+
+	return s.storeManifest(manifest, server, KindBaseBackup, "", "pg_basebackup", options)
+}
+
+// readBasebackupOutput records the WAL positions reported by pg_basebackup
+// and logs its progress lines at a limited rate.
+func (s *Service) readBasebackupOutput(stderr io.Reader, info *PhysicalInfo, messages *bytes.Buffer) {
+	scanner := bufio.NewScanner(stderr)
+	// Progress updates are separated by carriage returns, not newlines.
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	var lastProgress time.Time
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if match := walStartPattern.FindStringSubmatch(line); match != nil {
+			info.StartLSN = match[1]
+			info.Timeline, _ = strconv.Atoi(match[2])
+		}
+		if match := walEndPattern.FindStringSubmatch(line); match != nil {
+			info.StopLSN = match[1]
+		}
+
+		if strings.Contains(line, "kB (") && strings.Contains(line, "tablespace") {
+			if time.Since(lastProgress) >= progressInterval {
+				s.logger.Info("pg_basebackup progress: %s", line)
+				lastProgress = time.Now()
+			}
+			continue
+		}
+
+		messages.WriteString(line)
+		messages.WriteString("\n")
+	}
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"pg-backup/internal/config"
+)
+
+// toolDirs are appended to the PATH of the PostgreSQL client tools so that
+// pg_dumpall can find pg_dump on distributions that install it outside the
+// usual bin directories.
+const toolDirs = "/usr/libexec/postgresql:/usr/bin:/usr/sbin:/bin:/sbin"
+
+// baseToolEnv returns the environment of pg-backup with toolDirs added to
+// the PATH.
+func baseToolEnv() []string {
+	path := toolDirs
+	if inherited := os.Getenv("PATH"); inherited != "" {
+		path = inherited + string(os.PathListSeparator) + toolDirs
+	}
+	return append(os.Environ(), "PATH="+path)
+}
+
+// connString builds a lib/pq connection string for database on server.
+func connString(server config.Server, database, sslmode string) string {
+	params := []string{
+		"host=" + quoteConnValue(server.Host),
+		fmt.Sprintf("port=%d", server.Port),
+		"user=" + quoteConnValue(server.User),
+		"dbname=" + quoteConnValue(database),
+		"sslmode=" + sslmode,
+	}
+	if password := server.PasswordFor(database); password != "" {
+		params = append(params, "password="+quoteConnValue(password))
+	}
+	if server.SSLRootCert != "" {
+		params = append(params, "sslrootcert="+quoteConnValue(server.SSLRootCert))
+	}
+	if server.SSLCert != "" {
+		params = append(params, "sslcert="+quoteConnValue(server.SSLCert))
+	}
+	if server.SSLKey != "" {
+		params = append(params, "sslkey="+quoteConnValue(server.SSLKey))
+	}
+	return strings.Join(params, " ")
+}
+
+func quoteConnValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// openDB connects to database on server. lib/pq has no "prefer" mode, so it
+// is emulated the way libpq does it: try TLS first and fall back to a plain
+// connection when the server does not support it.
+func openDB(server config.Server, database string) (*sql.DB, error) {
+	sslmode := server.SSLMode
+	if sslmode == "prefer" {
+		sslmode = "require"
+	}
+
+	db, err := ping(connString(server, database, sslmode))
+	if err != nil && server.SSLMode == "prefer" && strings.Contains(err.Error(), "SSL is not enabled on the server") {
+		db, err = ping(connString(server, database, "disable"))
+	}
+	return db, err
+}
+
+func ping(connStr string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to PostgreSQL: %w", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping PostgreSQL: %w", err)
+	}
+	return db, nil
+}
+
+// toolEnv returns the environment for pg_dump and pg_dumpall: pg-backup's
+// own, so settings such as HOME, PGSERVICEFILE or a proxy reach the tools,
+// with the configured connection settings taking precedence. Connection
+// security settings are passed as PGSSL* variables so the client tools use
+// exactly the same TLS configuration as the discovery connection. When a
+// variable appears twice the later value is used.
+func toolEnv(server config.Server, database string) []string {
+	env := append(baseToolEnv(), "PGSSLMODE="+server.SSLMode)
+	if password := server.PasswordFor(database); password != "" {
+		env = append(env, "PGPASSWORD="+password)
+	}
+	if server.SSLRootCert != "" {
+		env = append(env, "PGSSLROOTCERT="+server.SSLRootCert)
+	}
+	if server.SSLCert != "" {
+		env = append(env, "PGSSLCERT="+server.SSLCert)
+	}
+	if server.SSLKey != "" {
+		env = append(env, "PGSSLKEY="+server.SSLKey)
+	}
+	return env
+}
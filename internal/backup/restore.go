@@ -0,0 +1,453 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pg-backup/internal/config"
+)
+
+// RestoreTarget is where point-in-time recovery should stop. Exactly one of
+// Time, LSN and XID is set.
+type RestoreTarget struct {
+	Time time.Time
+	LSN  string
+	XID  string
+	// Action is recovery_target_action: pause, promote or shutdown.
+	Action string
+}
+
+// PITROptions describes a point-in-time restore.
+type PITROptions struct {
+	Server  string
+	DataDir string
+	Target  RestoreTarget
+	// Base selects a base backup by name instead of picking one.
+	Base string
+	// RestoreCommand is written as restore_command and must fetch archived
+	// WAL, normally by running this tool's wal-fetch command.
+	RestoreCommand string
+}
+
+// RestorePITR prepares a data directory for point-in-time recovery: it
+// picks the newest base backup that finished before the target, checks that
+// the archived WAL covers the range from that backup to the target,
+// extracts the backup and configures recovery. Starting PostgreSQL on the
+// data directory then replays WAL up to the target.
+func (s *Service) RestorePITR(opts PITROptions) (*PhysicalInfo, error) {
+	job := s.snapshot()
+	defer job.release()
+	server, err := job.server(opts.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkEmptyDir(opts.DataDir); err != nil {
+		return nil, err
+	}
+
+	base, err := job.chooseBaseBackup(server, opts)
+	if err != nil {
+		return nil, err
+	}
+	job.logger.Info("Restoring base backup %s (WAL %s to %s, timeline %d)", base.Archive, base.StartLSN, base.StopLSN, base.Timeline)
+
+	if err := job.checkWALCoverage(server, base, opts.Target); err != nil {
+		return nil, err
+	}
+
+	if err := job.extractBaseBackup(base.Archive, opts.DataDir); err != nil {
+		return nil, err
+	}
+
+	if err := writeRecoveryConfig(opts); err != nil {
+		return nil, err
+	}
+
+	job.logger.Info("Data directory %s is ready for recovery", opts.DataDir)
+	return base, nil
+}
+
+// chooseBaseBackup returns the newest base backup that is consistent before
+// the recovery target. For transaction ID targets the position cannot be
+// known in advance, so the newest base backup is used.
+func (s *Service) chooseBaseBackup(server config.Server, opts PITROptions) (*PhysicalInfo, error) {
+	artifacts, err := s.listArtifacts(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	var targetLSN uint64
+	if opts.Target.LSN != "" {
+		if targetLSN, err = ParseLSN(opts.Target.LSN); err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates []*PhysicalInfo
+	for _, a := range artifacts {
+		if a.kind != KindBaseBackup {
+			continue
+		}
+		if opts.Base != "" && !isNamed(server, a, opts.Base) {
+			continue
+		}
+		info, err := s.readPhysicalInfo(a.name)
+		if err != nil {
+			s.logger.Warning("Skipping base backup %s: %v", a.name, err)
+			continue
+		}
+		if info.StartLSN == "" || info.StopLSN == "" {
+			s.logger.Warning("Skipping base backup %s: WAL positions unknown", a.name)
+			continue
+		}
+		candidates = append(candidates, info)
+	}
+	if opts.Base != "" && len(candidates) == 0 {
+		return nil, fmt.Errorf("base backup %s not found", opts.Base)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].StopTime.After(candidates[j].StopTime)
+	})
+
+	for _, info := range candidates {
+		switch {
+		case !opts.Target.Time.IsZero():
+			if info.StopTime.After(opts.Target.Time) {
+				continue
+			}
+		case opts.Target.LSN != "":
+			stop, err := ParseLSN(info.StopLSN)
+			if err != nil || stop > targetLSN {
+				continue
+			}
+		}
+		return info, nil
+	}
+
+	return nil, fmt.Errorf("no base backup finished before the recovery target")
+}
+
+// checkWALCoverage verifies that every WAL segment from the start of the
+// base backup up to the target is archived, with no gaps. Recovery follows
+// the newest archived timeline, as PostgreSQL does by default, so each
+// segment is looked up on the timeline the history file assigns to it. For
+// time and transaction ID targets the end segment is unknown, so the archive
+// must be gap-free up to its newest segment, and for time targets that
+// segment must have been archived after the target time.
+func (s *Service) checkWALCoverage(server config.Server, base *PhysicalInfo, target RestoreTarget) error {
+	segmentSize, err := config.ParseSize(server.WALSegmentSize)
+	if err != nil {
+		return err
+	}
+	start, err := ParseLSN(base.StartLSN)
+	if err != nil {
+		return err
+	}
+	stop, err := ParseLSN(base.StopLSN)
+	if err != nil {
+		return err
+	}
+
+	objects, err := s.storage.List(server.Prefix + walDir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL: %w", err)
+	}
+
+	baseTimeline := uint64(base.Timeline)
+	if baseTimeline == 0 {
+		baseTimeline = 1
+	}
+	size := uint64(segmentSize)
+	archived := make(map[walSegment]time.Time)
+	latest := baseTimeline
+	for _, object := range objects {
+		name := strings.TrimSuffix(strings.TrimPrefix(object.Name, server.Prefix+walDir), ".gz")
+		if match := historyPattern.FindStringSubmatch(name); match != nil {
+			timeline, _ := strconv.ParseUint(match[1], 16, 32)
+			if timeline > latest {
+				latest = timeline
+			}
+			continue
+		}
+		if strings.Contains(name, ".") {
+			continue
+		}
+		timeline, segmentStart, ok := parseSegmentName(name, segmentSize)
+		if !ok {
+			continue
+		}
+		key := walSegment{timeline, segmentStart}
+		if object.ModTime.After(archived[key]) {
+			archived[key] = object.ModTime
+		}
+	}
+
+	path := []timelineSpan{{timeline: baseTimeline}}
+	if latest != baseTimeline {
+		if path, err = s.timelinePath(server, baseTimeline, latest); err != nil {
+			return err
+		}
+		if start >= path[1].begin {
+			return fmt.Errorf("base backup %s started on timeline %d after timeline %d branched off it", base.Archive, baseTimeline, path[1].timeline)
+		}
+	}
+	// segmentTimeline returns the timeline PostgreSQL reads a segment from:
+	// the newest one that had begun by the start of that segment.
+	segmentTimeline := func(segment uint64) uint64 {
+		for i := len(path) - 1; i > 0; i-- {
+			if path[i].begin-path[i].begin%size <= segment {
+				return path[i].timeline
+			}
+		}
+		return path[0].timeline
+	}
+
+	var newest walSegment
+	for key := range archived {
+		if key.start >= newest.start && key.start >= start-start%size && segmentTimeline(key.start) == key.timeline {
+			newest = key
+		}
+	}
+
+	end := newest.start
+	if target.LSN != "" {
+		if end, err = ParseLSN(target.LSN); err != nil {
+			return err
+		}
+	}
+	if end < stop {
+		end = stop
+	}
+
+	for segment := start - start%size; segment <= end; segment += size {
+		timeline := segmentTimeline(segment)
+		if _, ok := archived[walSegment{timeline, segment}]; !ok {
+			return fmt.Errorf("archived WAL is missing the segment starting at %X/%X on timeline %d; the target is not reachable from %s",
+				segment>>32, uint32(segment), timeline, base.Archive)
+		}
+	}
+
+	if !target.Time.IsZero() && !archived[newest].After(target.Time) {
+		return fmt.Errorf("the newest archived WAL was written at %s, before the recovery target %s",
+			archived[newest].Format(time.RFC3339), target.Time.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// historyPattern matches timeline history file names.
+var historyPattern = regexp.MustCompile(`^([0-9A-F]{8})\.history$`)
+
+// walSegment identifies an archived WAL segment by its timeline and the
+// position at which it starts.
+type walSegment struct {
+	timeline uint64
+	start    uint64
+}
+
+// timelineSpan is a timeline on the way to the recovery target and the
+// position at which it branched off its parent.
+type timelineSpan struct {
+	timeline uint64
+	begin    uint64
+}
+
+// timelinePath reads the history file of timeline latest and returns the
+// timelines recovery passes through, from base to latest, in order.
+func (s *Service) timelinePath(server config.Server, base, latest uint64) ([]timelineSpan, error) {
+	name := fmt.Sprintf("%08X.history", latest)
+	data, err := s.readWAL(walObjectName(server, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read timeline history %s: %w", name, err)
+	}
+
+	// Each line holds a parent timeline, the position where its child
+	// branched off, and a reason.
+	var path []timelineSpan
+	var begin uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		timeline, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeline history %s: %q", name, line)
+		}
+		switchPoint, err := ParseLSN(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeline history %s: %w", name, err)
+		}
+		if timeline >= base {
+			path = append(path, timelineSpan{timeline: timeline, begin: begin})
+		}
+		begin = switchPoint
+	}
+	if len(path) == 0 || path[0].timeline != base {
+		return nil, fmt.Errorf("timeline %d of the base backup is not an ancestor of the latest timeline %d", base, latest)
+	}
+	path[0].begin = 0
+	return append(path, timelineSpan{timeline: latest, begin: begin}), nil
+}
+
+// extractBaseBackup unpacks a gzipped pg_basebackup tar into dataDir.
+// Symbolic links must point inside the data directory, and are created only
+// after every file has been written, so no entry can be written through one.
+func (s *Service) extractBaseBackup(archive, dataDir string) error {
+	reader, err := s.storage.Open(archive)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", archive, err)
+	}
+	defer reader.Close()
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", archive, err)
+	}
+	defer gzipReader.Close()
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	files := 0
+	var links []*tar.Header
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", archive, err)
+		}
+
+		target := filepath.Join(dataDir, header.Name)
+		if target != filepath.Clean(dataDir) && !strings.HasPrefix(target, filepath.Clean(dataDir)+string(os.PathSeparator)) {
+			return fmt.Errorf("refusing to extract %q outside the data directory", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			if err := writeFile(target, tarReader, header.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+			files++
+		case tar.TypeSymlink:
+			if !localLink(header.Linkname) {
+				return fmt.Errorf("refusing to extract link %q to %q outside the data directory", header.Name, header.Linkname)
+			}
+			links = append(links, header)
+		default:
+			s.logger.Warning("Skipping unsupported tar entry %s", header.Name)
+		}
+	}
+
+	for _, link := range links {
+		if err := os.Symlink(link.Linkname, filepath.Join(dataDir, link.Name)); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Info("Extracted %d files from %s into %s", files, archive, dataDir)
+	return nil
+}
+
+// localLink reports whether a symbolic link target is relative and does not
+// climb out of the directory holding the link.
+func localLink(linkname string) bool {
+	if linkname == "" || filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return false
+	}
+	for _, element := range strings.Split(filepath.ToSlash(linkname), "/") {
+		if element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func writeFile(path string, data io.Reader, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeRecoveryConfig creates recovery.signal and appends the recovery
+// settings to postgresql.auto.conf, which takes precedence over
+// postgresql.conf.
+func writeRecoveryConfig(opts PITROptions) error {
+	settings := []string{
+		"",
+		"# Added by pg-backup restore-pitr at " + time.Now().Format(time.RFC3339),
+		"restore_command = " + quoteSetting(opts.RestoreCommand),
+	}
+	switch {
+	case !opts.Target.Time.IsZero():
+		settings = append(settings, "recovery_target_time = "+quoteSetting(opts.Target.Time.Format("2006-01-02 15:04:05.999999-07:00")))
+	case opts.Target.LSN != "":
+		settings = append(settings, "recovery_target_lsn = "+quoteSetting(opts.Target.LSN))
+	case opts.Target.XID != "":
+		settings = append(settings, "recovery_target_xid = "+quoteSetting(opts.Target.XID))
+	}
+	if opts.Target.Action != "" {
+		settings = append(settings, "recovery_target_action = "+quoteSetting(opts.Target.Action))
+	}
+
+	autoConf, err := os.OpenFile(filepath.Join(opts.DataDir, "postgresql.auto.conf"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := autoConf.WriteString(strings.Join(settings, "\n") + "\n"); err != nil {
+		autoConf.Close()
+		return err
+	}
+	if err := autoConf.Close(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(opts.DataDir, "recovery.signal"), nil, 0600)
+}
+
+func quoteSetting(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// checkEmptyDir refuses to restore over an existing data directory.
+func checkEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("data directory %s is not empty", dir)
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pg-backup/internal/config"
+	"pg-backup/internal/logger"
+	"pg-backup/internal/storage"
+)
+
+// tarEntry is one member of a crafted base backup archive.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+// storeArchive writes entries as a gzipped tar named archive to provider.
+func storeArchive(t *testing.T, provider storage.Provider, archive string, entries []tarEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0600,
+			Size:     int64(len(entry.body)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0700
+		}
+		if entry.typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if entry.typeflag == tar.TypeReg {
+			if _, err := tarWriter.Write([]byte(entry.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Store(archive, &buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractBaseBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		wantErr bool
+		// files maps paths relative to the data directory to their content.
+		files map[string]string
+		// links maps paths relative to the data directory to link targets.
+		links map[string]string
+	}{
+		{
+			name: "files and local link",
+			entries: []tarEntry{
+				{name: "global", typeflag: tar.TypeDir},
+				{name: "global/pg_control", typeflag: tar.TypeReg, body: "control"},
+				{name: "current", typeflag: tar.TypeSymlink, linkname: "global/pg_control"},
+			},
+			files: map[string]string{"global/pg_control": "control", "current": "control"},
+			links: map[string]string{"current": "global/pg_control"},
+		},
+		{
+			name: "absolute link",
+			entries: []tarEntry{
+				{name: "pg_wal", typeflag: tar.TypeSymlink, linkname: "OUTSIDE"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "link climbing out",
+			entries: []tarEntry{
+				{name: "pg_wal", typeflag: tar.TypeSymlink, linkname: "../outside"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "link climbing out from a subdirectory",
+			entries: []tarEntry{
+				{name: "base", typeflag: tar.TypeDir},
+				{name: "base/escape", typeflag: tar.TypeSymlink, linkname: "ok/../../../outside"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "file written through an earlier link",
+			entries: []tarEntry{
+				{name: "sub", typeflag: tar.TypeDir},
+				{name: "pg_wal", typeflag: tar.TypeSymlink, linkname: "sub"},
+				{name: "pg_wal/000000010000000000000001", typeflag: tar.TypeReg, body: "wal"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "entry outside the data directory",
+			entries: []tarEntry{
+				{name: "../outside/file", typeflag: tar.TypeReg, body: "data"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			outside := filepath.Join(root, "outside")
+			if err := os.Mkdir(outside, 0700); err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.entries {
+				if tt.entries[i].linkname == "OUTSIDE" {
+					tt.entries[i].linkname = outside
+				}
+			}
+
+			provider := storage.NewLocal(storage.LocalOptions{Path: filepath.Join(root, "storage")})
+			storeArchive(t, provider, "base.tar.gz", tt.entries)
+			s := NewService(&config.Config{}, provider, logger.New(filepath.Join(root, "backup.log")))
+			dataDir := filepath.Join(root, "data")
+
+			err := s.extractBaseBackup("base.tar.gz", dataDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractBaseBackup returned %v, want error %v", err, tt.wantErr)
+			}
+
+			escaped, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(escaped) > 0 {
+				t.Errorf("extraction wrote %s outside the data directory", escaped[0].Name())
+			}
+			if tt.wantErr {
+				return
+			}
+			for name, want := range tt.files {
+				got, err := os.ReadFile(filepath.Join(dataDir, name))
+				if err != nil {
+					t.Errorf("reading %s: %v", name, err)
+				} else if string(got) != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			for name, want := range tt.links {
+				got, err := os.Readlink(filepath.Join(dataDir, name))
+				if err != nil {
+					t.Errorf("reading link %s: %v", name, err)
+				} else if got != want {
+					t.Errorf("link %s points to %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// storeWAL archives a WAL or timeline history file the way PushWAL does.
+func storeWAL(t *testing.T, provider storage.Provider, server config.Server, name, data string) {
+	t.Helper()
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	gzipWriter.Write([]byte(data))
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.Store(walObjectName(server, name), &buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWALCoverage(t *testing.T) {
+	const history2 = "1\t0/3000158\tno recovery target specified\n"
+	tests := []struct {
+		name     string
+		startLSN string
+		files    map[string]string
+		wantErr  string
+	}{
+		{
+			name: "single timeline",
+			files: map[string]string{
+				"000000010000000000000001": "", "000000010000000000000002": "",
+				"000000010000000000000003": "", "000000010000000000000004": "",
+			},
+		},
+		{
+			name: "follows the history to the latest timeline",
+			files: map[string]string{
+				"000000010000000000000001": "", "000000010000000000000002": "",
+				"00000002.history":         history2,
+				"000000020000000000000003": "", "000000020000000000000004": "",
+			},
+		},
+		{
+			name: "segment after the switch archived only on the parent",
+			files: map[string]string{
+				"000000010000000000000001": "", "000000010000000000000002": "",
+				"000000010000000000000003": "", "000000010000000000000004": "",
+				"00000002.history":         history2,
+				"000000020000000000000003": "",
+			},
+			wantErr: "segment starting at 0/4000000 on timeline 2",
+		},
+		{
+			name: "gap on the latest timeline",
+			files: map[string]string{
+				"000000010000000000000001": "", "000000010000000000000002": "",
+				"00000002.history":         history2,
+				"000000020000000000000004": "",
+			},
+			wantErr: "segment starting at 0/3000000 on timeline 2",
+		},
+		{
+			name: "base timeline is not an ancestor",
+			files: map[string]string{
+				"000000010000000000000001": "", "000000010000000000000002": "",
+				"00000003.history":         "2\t0/3000158\tno recovery target specified\n",
+				"000000030000000000000003": "", "000000030000000000000004": "",
+			},
+			wantErr: "not an ancestor",
+		},
+		{
+			name:     "base started after the branch",
+			startLSN: "0/3800028",
+			files: map[string]string{
+				"000000010000000000000003": "",
+				"00000002.history":         history2,
+				"000000020000000000000003": "", "000000020000000000000004": "",
+			},
+			wantErr: "after timeline 2 branched off it",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			server := config.Server{Name: "main", Database: config.Database{WALSegmentSize: "16MB"}, Prefix: "main/"}
+			provider := storage.NewLocal(storage.LocalOptions{Path: root})
+			for name, data := range tt.files {
+				storeWAL(t, provider, server, name, data)
+			}
+			s := NewService(&config.Config{}, provider, logger.New(filepath.Join(t.TempDir(), "backup.log")))
+			base := &PhysicalInfo{Archive: "base.tar.gz", StartLSN: "0/1000028", StopLSN: "0/1000100", Timeline: 1}
+			if tt.startLSN != "" {
+				base.StartLSN, base.StopLSN = tt.startLSN, tt.startLSN
+			}
+
+			err := s.checkWALCoverage(server, base, RestoreTarget{LSN: "0/4000100"})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkWALCoverage returned %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("checkWALCoverage returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"pg-backup/internal/config"
+	"pg-backup/internal/storage"
+)
+
+// PruneDecision records whether retention keeps a backup and why.
+type PruneDecision struct {
+	Server      string `json:"server"`
+	Destination string `json:"destination"`
+	Artifact    string `json:"artifact"`
+	Keep        bool   `json:"keep"`
+	Reason      string `json:"reason"`
+}
+
+// applyRetention deletes the backups of server that the retention policy no
+// longer keeps. The most recent backup of each database (or server-wide
+// kind) is always kept so a stalled schedule cannot expire the last good
+// copy. WAL that is no longer needed by any retained base backup is removed
+// afterwards. Each destination is pruned with its own retention settings.
+func (s *Service) applyRetention(server config.Server) error {
+	_, err := s.pruneDestinations(server, false)
+	return err
+}
+
+func (s *Service) pruneDestinations(server config.Server, dryRun bool) ([]PruneDecision, error) {
+	var decisions []PruneDecision
+	var errs []error
+	for _, destination := range s.destinations() {
+		destinationDecisions, err := destination.job.prune(server, destination.name, dryRun)
+		decisions = append(decisions, destinationDecisions...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", destination.name, err))
+		}
+	}
+	return decisions, errors.Join(errs...)
+}
+
+type destinationJob struct {
+	name string
+	job  *Service
+}
+
+// destinations returns a copy of the service for every storage destination,
+// bound to that destination alone and to its retention settings.
+func (s *Service) destinations() []destinationJob {
+	multi, ok := s.storage.(*storage.Multi)
+	if !ok {
+		return []destinationJob{{name: config.DefaultServerName, job: s}}
+	}
+
+	settings := make(map[string]config.Destination)
+	for _, destination := range s.dbConfig.DestinationList() {
+		settings[destination.Name] = destination
+	}
+
+	var jobs []destinationJob
+	for _, target := range multi.Targets() {
+		cfg := *s.dbConfig
+		cfg.RetentionDays = settings[target.Name].RetentionDays
+		cfg.Retention = settings[target.Name].Retention
+		jobs = append(jobs, destinationJob{
+			name: target.Name,
+			job: &Service{
+				dbConfig: &cfg,
+				storage:  target.Provider,
+				logger:   s.logger,
+				observer: s.observer,
+				use:      s.use,
+			},
+		})
+	}
+	return jobs
+}
+
+// onDestination names destination in log messages when several
+// destinations are configured.
+func (s *Service) onDestination(destination string) string {
+	if len(s.dbConfig.Destinations) == 0 {
+		return ""
+	}
+	return " on destination " + destination
+}
+
+// Prune applies retention to the named server, or to every server when
+// serverName is empty, and returns the decision taken for each backup.
+// With dryRun nothing is deleted.
+func (s *Service) Prune(serverName string, dryRun bool) ([]PruneDecision, error) {
+	job := s.snapshot()
+	defer job.release()
+
+	servers := job.dbConfig.ServerList()
+	if serverName != "" {
+		server, err := job.server(serverName)
+		if err != nil {
+			return nil, err
+		}
+		servers = []config.Server{server}
+	}
+
+	var decisions []PruneDecision
+	for _, server := range servers {
+		serverDecisions, err := job.pruneDestinations(server, dryRun)
+		decisions = append(decisions, serverDecisions...)
+		if err != nil {
+			return decisions, fmt.Errorf("server %s: %w", server.Name, err)
+		}
+	}
+	return decisions, nil
+}
+
+func (s *Service) prune(server config.Server, destination string, dryRun bool) ([]PruneDecision, error) {
+	artifacts, err := s.listArtifacts(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	reasons := s.retentionReasons(artifacts)
+	enabled := reasons != nil
+
+	var decisions []PruneDecision
+	var retained []artifact
+	for _, a := range artifacts {
+		decision := PruneDecision{Server: server.Name, Destination: destination, Artifact: a.name, Keep: true}
+		switch {
+		case !enabled:
+			decision.Reason = "retention disabled"
+		case len(reasons[a.name]) > 0:
+			decision.Reason = strings.Join(reasons[a.name], ", ")
+		default:
+			decision.Keep = false
+			decision.Reason = s.deleteReason()
+		}
+		if decision.Keep || dryRun {
+			decisions = append(decisions, decision)
+			if decision.Keep {
+				retained = append(retained, a)
+			}
+			continue
+		}
+
+		if len(s.dbConfig.Destinations) > 0 {
+			s.logger.Info("Retention: deleting %s from destination %s (%s)", a.name, destination, decision.Reason)
+		} else {
+			s.logger.Info("Retention: deleting %s (%s)", a.name, decision.Reason)
+		}
+		err := s.deleteArtifact(a)
+		if errors.Is(err, storage.ErrLocked) {
+			// An immutable backup is kept until its lock expires and
+			// deleted by a later run.
+			s.logger.Info("Retention: keeping %s: %v", a.name, err)
+			decision.Keep = true
+			decision.Reason = "locked"
+			retained = append(retained, a)
+			err = nil
+		}
+		decisions = append(decisions, decision)
+		if err != nil {
+			return decisions, err
+		}
+	}
+
+	if !enabled || dryRun {
+		return decisions, nil
+	}
+	return decisions, s.pruneWAL(server, retained)
+}
+
+// retentionReasons returns, for every backup that is kept, the rules that
+// keep it. It returns nil when retention is disabled.
+func (s *Service) retentionReasons(artifacts []artifact) map[string][]string {
+	policy := s.dbConfig.Retention
+	if !policy.IsSet() && s.dbConfig.RetentionDays <= 0 {
+		return nil
+	}
+
+	reasons := make(map[string][]string)
+	keep := func(a artifact, reason string) {
+		reasons[a.name] = append(reasons[a.name], reason)
+	}
+
+	// Rules are applied per database (or server-wide kind), newest first.
+	groups := make(map[string][]artifact)
+	var keys []string
+	for i := len(artifacts) - 1; i >= 0; i-- {
+		a := artifacts[i]
+		if _, ok := groups[a.key]; !ok {
+			keys = append(keys, a.key)
+		}
+		groups[a.key] = append(groups[a.key], a)
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		keep(group[0], "newest backup of "+key)
+
+		if !policy.IsSet() {
+			cutoff := time.Now().AddDate(0, 0, -s.dbConfig.RetentionDays)
+			for _, a := range group {
+				if !a.time.Before(cutoff) {
+					keep(a, fmt.Sprintf("newer than %d days", s.dbConfig.RetentionDays))
+				}
+			}
+			continue
+		}
+
+		for _, rule := range retentionRules(policy) {
+			if rule.count == 0 {
+				continue
+			}
+			periods := make(map[string]bool)
+			for _, a := range group {
+				period := rule.period(a)
+				if periods[period] {
+					continue
+				}
+				if rule.count > 0 && len(periods) >= rule.count {
+					break
+				}
+				periods[period] = true
+				keep(a, rule.name+" "+period)
+			}
+		}
+	}
+	return reasons
+}
+
+type retentionRule struct {
+	name  string
+	count int
+	// period names the period a backup falls in; the newest backup of each
+	// of the most recent count periods is kept.
+	period func(artifact) string
+}
+
+func retentionRules(policy config.Retention) []retentionRule {
+	return []retentionRule{
+		{"last", policy.KeepLast, func(a artifact) string {
+			return a.time.Format("2006-01-02 15:04:05")
+		}},
+		{"daily", policy.KeepDaily, func(a artifact) string {
+			return a.time.Format("2006-01-02")
+		}},
+		{"weekly", policy.KeepWeekly, func(a artifact) string {
+			year, week := a.time.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.KeepMonthly, func(a artifact) string {
+			return a.time.Format("2006-01")
+		}},
+		{"yearly", policy.KeepYearly, func(a artifact) string {
+			return a.time.Format("2006")
+		}},
+	}
+}
+
+func (s *Service) deleteReason() string {
+	if s.dbConfig.Retention.IsSet() {
+		return "not kept by any retention rule"
+	}
+	return fmt.Sprintf("older than %d days", s.dbConfig.RetentionDays)
+}
+
+// deleteArtifact removes a backup together with its sidecar files. The
+// sidecars go first: they were stored after the backup, so if one of them
+// is still locked the backup is too, and nothing is left half deleted.
+func (s *Service) deleteArtifact(a artifact) error {
+	names := []string{a.name + VerificationSuffix, a.name + ManifestSuffix}
+	if a.kind == KindBaseBackup {
+		names = append(names, a.name+InfoSuffix)
+	}
+	names = append(names, a.name)
+
+	for _, name := range names {
+		if err := s.storage.Delete(name); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// readPhysicalInfo loads the info file stored next to a base backup.
+func (s *Service) readPhysicalInfo(archive string) (*PhysicalInfo, error) {
+	reader, err := s.storage.Open(archive + InfoSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var info PhysicalInfo
+	if err := json.NewDecoder(reader).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", archive+InfoSuffix, err)
+	}
+	return &info, nil
+}
@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"pg-backup/internal/config"
+	"pg-backup/internal/logger"
+	"pg-backup/internal/storage"
+)
+
+// testArtifact is a backup of key taken at the given time, named after both.
+func testArtifact(kind, key string, taken time.Time) artifact {
+	return artifact{name: key + "_" + taken.Format(timestampFormat), key: key, kind: kind, time: taken}
+}
+
+func TestRetentionReasons(t *testing.T) {
+	at := func(date string) artifact {
+		taken, err := time.Parse("2006-01-02 15:04", date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testArtifact(KindDatabase, "app", taken)
+	}
+	// Oldest first, as listArtifacts returns them. ISO weeks: 2023-W52,
+	// 2024-W03 and 2024-W05 for the rest.
+	artifacts := []artifact{
+		at("2023-12-31 02:00"),
+		at("2024-01-15 02:00"),
+		at("2024-01-31 02:00"),
+		at("2024-02-01 02:00"),
+		at("2024-02-01 14:00"),
+		at("2024-02-02 02:00"),
+	}
+
+	now := time.Now()
+	recent := []artifact{
+		testArtifact(KindDatabase, "app", now.AddDate(0, 0, -40)),
+		testArtifact(KindDatabase, "app", now.AddDate(0, 0, -10)),
+		testArtifact(KindDatabase, "app", now.AddDate(0, 0, -1)),
+	}
+
+	tests := []struct {
+		name      string
+		days      int
+		policy    config.Retention
+		artifacts []artifact
+		// want lists the kept backups by index into artifacts; nil means
+		// retention is disabled.
+		want []int
+	}{
+		{name: "disabled", artifacts: artifacts},
+		{name: "keep all days", days: -1, artifacts: artifacts},
+		{name: "days", days: 30, artifacts: recent, want: []int{1, 2}},
+		{name: "last", policy: config.Retention{KeepLast: 2}, artifacts: artifacts, want: []int{4, 5}},
+		{name: "daily", policy: config.Retention{KeepDaily: 2}, artifacts: artifacts, want: []int{4, 5}},
+		{name: "weekly", policy: config.Retention{KeepWeekly: 2}, artifacts: artifacts, want: []int{1, 5}},
+		{name: "monthly", policy: config.Retention{KeepMonthly: 2}, artifacts: artifacts, want: []int{2, 5}},
+		{name: "yearly", policy: config.Retention{KeepYearly: 1}, artifacts: artifacts, want: []int{5}},
+		{name: "every year", policy: config.Retention{KeepYearly: -1}, artifacts: artifacts, want: []int{0, 5}},
+		{name: "every day", policy: config.Retention{KeepDaily: -1}, artifacts: artifacts, want: []int{0, 1, 2, 4, 5}},
+		{name: "combined", policy: config.Retention{KeepLast: 1, KeepMonthly: 2, KeepYearly: -1}, artifacts: artifacts, want: []int{0, 2, 5}},
+		{
+			name:   "per database",
+			policy: config.Retention{KeepLast: 1},
+			artifacts: []artifact{
+				testArtifact(KindGlobals, "globals", time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)),
+				testArtifact(KindDatabase, "app", time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)),
+				testArtifact(KindDatabase, "app", time.Date(2024, 1, 2, 2, 0, 0, 0, time.UTC)),
+				testArtifact(KindDatabase, "billing", time.Date(2024, 1, 2, 2, 0, 0, 0, time.UTC)),
+			},
+			want: []int{0, 2, 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{dbConfig: &config.Config{RetentionDays: tt.days, Retention: tt.policy}}
+			reasons := s.retentionReasons(tt.artifacts)
+			if tt.want == nil {
+				if reasons != nil {
+					t.Errorf("retention kept %v, want it disabled", reasons)
+				}
+				return
+			}
+
+			var got, want []string
+			for name := range reasons {
+				got = append(got, name)
+			}
+			for _, i := range tt.want {
+				want = append(want, tt.artifacts[i].name)
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("kept %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPruneWAL(t *testing.T) {
+	wal := []string{
+		"000000010000000000000001",
+		"000000010000000000000002",
+		"000000010000000000000003",
+		"000000010000000000000003.00000028.backup",
+		"000000010000000000000004",
+		"000000010000000000000005",
+		"00000002.history",
+		"000000020000000000000004",
+		"000000020000000000000005",
+	}
+	base := func(name, startLSN string) (artifact, PhysicalInfo) {
+		a := testArtifact(KindBaseBackup, "basebackup", time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC))
+		a.name = name
+		return a, PhysicalInfo{Archive: name, StartLSN: startLSN, Timeline: 1}
+	}
+	older, olderInfo := base("basebackup_1.tar.gz", "0/3000028")
+	newer, newerInfo := base("basebackup_2.tar.gz", "0/5000028")
+	unknown, unknownInfo := base("basebackup_3.tar.gz", "")
+
+	tests := []struct {
+		name     string
+		retained []artifact
+		// deleted lists the WAL files expected to be gone, by index.
+		deleted []int
+	}{
+		{"oldest retained base backup", []artifact{older, newer}, []int{0, 1}},
+		{"only the newer base backup", []artifact{newer}, []int{0, 1, 2, 3, 4}},
+		{"logical backups only", []artifact{testArtifact(KindDatabase, "app", time.Now())}, nil},
+		{"unknown start position", []artifact{unknown, newer}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			server := config.Server{Name: "main", Database: config.Database{WALSegmentSize: "16MB"}, Prefix: "main/"}
+			provider := storage.NewLocal(storage.LocalOptions{Path: filepath.Join(root, "storage")})
+			for _, info := range []PhysicalInfo{olderInfo, newerInfo, unknownInfo} {
+				data, _ := json.Marshal(info)
+				if err := provider.Store(info.Archive+InfoSuffix, bytes.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, name := range wal {
+				storeWAL(t, provider, server, name, name)
+			}
+			s := NewService(&config.Config{}, provider, logger.New(filepath.Join(root, "backup.log")))
+
+			if err := s.pruneWAL(server, tt.retained); err != nil {
+				t.Fatalf("pruneWAL: %v", err)
+			}
+
+			deleted := make(map[int]bool)
+			for _, i := range tt.deleted {
+				deleted[i] = true
+			}
+			for i, name := range wal {
+				reader, err := provider.Open(walObjectName(server, name))
+				if err == nil {
+					reader.Close()
+				}
+				if gone := err != nil; gone != deleted[i] {
+					t.Errorf("%s deleted: %v, want %v", name, gone, deleted[i])
+				}
+			}
+		})
+	}
+}
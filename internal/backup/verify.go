@@ -0,0 +1,306 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"pg-backup/internal/config"
+
+	"github.com/lib/pq"
+)
+
+// VerificationSuffix is appended to a backup name to get the name of the
+// file recording its most recent verification.
+const VerificationSuffix = ".verify.json"
+
+// VerificationResult records a restore test of one backup.
+type VerificationResult struct {
+	Artifact    string            `json:"artifact"`
+	Server      string            `json:"server"`
+	Destination string            `json:"destination"`
+	Database    string            `json:"database"`
+	VerifiedAt  time.Time         `json:"verified_at"`
+	Duration    float64           `json:"duration_seconds"`
+	Success     bool              `json:"success"`
+	Error       string            `json:"error,omitempty"`
+	Tables      int               `json:"tables"`
+	Assertions  []AssertionResult `json:"assertions,omitempty"`
+}
+
+// AssertionResult is the outcome of one user-defined assertion.
+type AssertionResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// Verify restores the newest backup of every database of the named server,
+// or of every server when serverName is empty, into a scratch database and
+// checks it. It returns the number of backups verified successfully.
+func (s *Service) Verify(serverName string) (int, error) {
+	job := s.snapshot()
+	defer job.release()
+	if !job.dbConfig.Verification.Enabled {
+		return 0, fmt.Errorf("verification is not enabled")
+	}
+
+	servers := job.dbConfig.ServerList()
+	if serverName != "" {
+		server, err := job.server(serverName)
+		if err != nil {
+			return 0, err
+		}
+		servers = []config.Server{server}
+	}
+
+	total := 0
+	var errs []error
+	for _, server := range servers {
+		count, err := job.verifyServer(server)
+		total += count
+		if err != nil {
+			errs = append(errs, fmt.Errorf("server %s: %w", server.Name, err))
+		}
+	}
+	return total, errors.Join(errs...)
+}
+
+// verifyServer verifies the newest per-database backup of server on every
+// destination. The observer is told of each database once, failing if the
+// backup failed on any destination.
+func (s *Service) verifyServer(server config.Server) (int, error) {
+	verified := 0
+	var errs []error
+	var order []string
+	outcomes := make(map[string]VerificationResult)
+	failures := make(map[string][]error)
+	for _, destination := range s.destinations() {
+		results, err := destination.job.verifyDestination(server, destination.name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", destination.name, err))
+		}
+		for _, result := range results {
+			if _, seen := outcomes[result.Database]; !seen {
+				order = append(order, result.Database)
+			}
+			outcomes[result.Database] = result
+			if !result.Success {
+				failures[result.Database] = append(failures[result.Database], fmt.Errorf("destination %s: %s", result.Destination, result.Error))
+				errs = append(errs, fmt.Errorf("%s on destination %s: %s", result.Database, result.Destination, result.Error))
+				continue
+			}
+			verified++
+		}
+	}
+
+	if s.observer != nil {
+		for _, database := range order {
+			s.observer.VerificationFinished(server.Name, database, outcomes[database].VerifiedAt, errors.Join(failures[database]...))
+		}
+	}
+	return verified, errors.Join(errs...)
+}
+
+// verifyDestination verifies the newest per-database backup of server on
+// the one destination s is bound to. Full dumps, globals and base backups
+// cannot be restored into a single scratch database and are skipped.
+func (s *Service) verifyDestination(server config.Server, destination string) ([]VerificationResult, error) {
+	artifacts, err := s.listArtifacts(server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+
+	newest := make(map[string]artifact)
+	var order []string
+	for _, a := range artifacts {
+		if a.kind != KindDatabase {
+			continue
+		}
+		if _, seen := newest[a.key]; !seen {
+			order = append(order, a.key)
+		}
+		newest[a.key] = a
+	}
+	if len(order) == 0 {
+		s.logger.Info("No per-database backups to verify for server %s%s", server.Name, s.onDestination(destination))
+		return nil, nil
+	}
+
+	var results []VerificationResult
+	for _, database := range order {
+		result := s.verifyArtifact(server, newest[database])
+		result.Destination = destination
+		if err := s.storeVerification(result); err != nil {
+			s.logger.Warning("Failed to store verification result for %s%s: %v", result.Artifact, s.onDestination(destination), err)
+		}
+
+		if result.Success {
+			s.logger.Info("Verification of %s%s succeeded (%d tables, %d assertions) in %.1fs",
+				result.Artifact, s.onDestination(destination), result.Tables, len(result.Assertions), result.Duration)
+		} else {
+			s.logger.Error("Verification of %s%s failed: %s", result.Artifact, s.onDestination(destination), result.Error)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (s *Service) verifyArtifact(server config.Server, a artifact) VerificationResult {
+	start := time.Now()
+	result := VerificationResult{
+		Artifact: a.name,
+		Server:   server.Name,
+		Database: a.key,
+	}
+
+	err := s.restoreAndCheck(a, &result)
+	result.VerifiedAt = time.Now()
+	result.Duration = result.VerifiedAt.Sub(start).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+// restoreAndCheck restores a into a new scratch database, runs the sanity
+// checks and drops the database again.
+func (s *Service) restoreAndCheck(a artifact, result *VerificationResult) error {
+	verification := s.dbConfig.Verification
+	target := config.Server{Name: "verification", Database: verification.Server}
+
+	name := unsafeNameChars.ReplaceAllString(strings.ToLower(a.key), "_")
+	if len(name) > 30 {
+		name = name[:30]
+	}
+	scratch := fmt.Sprintf("pgbackup_verify_%s_%s", name, time.Now().Format("20060102150405"))
+
+	admin, err := openDB(target, "postgres")
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	if _, err := admin.Exec("CREATE DATABASE " + pq.QuoteIdentifier(scratch)); err != nil {
+		return fmt.Errorf("failed to create scratch database: %w", err)
+	}
+	s.logger.Info("Verifying %s in scratch database %s", a.name, scratch)
+	defer func() {
+		if _, err := admin.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(scratch)); err != nil {
+			s.logger.Warning("Failed to drop scratch database %s: %v", scratch, err)
+		}
+	}()
+
+	if err := s.restoreDump(target, scratch, a.name, verification.IgnoreErrors); err != nil {
+		return err
+	}
+
+	db, err := openDB(target, scratch)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.QueryRow(`
+		SELECT count(*)
+		FROM pg_tables
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema')
+	`).Scan(&result.Tables)
+	if err != nil {
+		return fmt.Errorf("failed to count tables: %w", err)
+	}
+	if result.Tables < verification.MinTables {
+		return fmt.Errorf("restored %d tables, expected at least %d", result.Tables, verification.MinTables)
+	}
+
+	failed := 0
+	for i, assertion := range verification.Assertions {
+		if assertion.Database != "" && assertion.Database != a.key {
+			continue
+		}
+		check := AssertionResult{Name: assertion.Name}
+		if check.Name == "" {
+			check.Name = fmt.Sprintf("assertion %d", i+1)
+		}
+
+		var passed bool
+		if err := db.QueryRow(assertion.SQL).Scan(&passed); err != nil {
+			check.Error = err.Error()
+		} else if !passed {
+			check.Error = "returned false"
+		} else {
+			check.Passed = true
+		}
+		if !check.Passed {
+			failed++
+		}
+		result.Assertions = append(result.Assertions, check)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d assertions failed", failed, len(result.Assertions))
+	}
+
+	return nil
+}
+
+// restoreDump streams a compressed plain-format dump into psql.
+func (s *Service) restoreDump(target config.Server, database, objectName string, ignoreErrors bool) error {
+	reader, err := s.storage.Open(objectName)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", objectName, err)
+	}
+	defer reader.Close()
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", objectName, err)
+	}
+	defer gzipReader.Close()
+
+	args := []string{
+		"-X", "-q",
+		"-h", target.Host,
+		"-p", fmt.Sprintf("%d", target.Port),
+		"-U", target.User,
+		"-d", database,
+		"--no-password",
+	}
+	if !ignoreErrors {
+		args = append(args, "-v", "ON_ERROR_STOP=1")
+	}
+
+	cmd := exec.Command("psql", args...)
+	cmd.Env = toolEnv(target, database)
+	cmd.Stdin = gzipReader
+	cmd.Stdout = io.Discard
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("psql restore failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		s.logger.Warning("psql reported problems restoring %s: %s", objectName, stderr.String())
+	}
+	return nil
+}
+
+func (s *Service) storeVerification(result VerificationResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.storage.Store(result.Artifact+VerificationSuffix, bytes.NewReader(data))
+}
@@ -0,0 +1,259 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"pg-backup/internal/config"
+	"pg-backup/internal/storage"
+)
+
+// walDir is the folder, below the server prefix, holding archived WAL.
+const walDir = "wal/"
+
+// walSegmentPattern matches WAL segment names and the .partial and .backup
+// files derived from them; timeline history files are not matched.
+var walSegmentPattern = regexp.MustCompile(`^([0-9A-F]{8})([0-9A-F]{8})([0-9A-F]{8})(\..*)?$`)
+
+func walObjectName(server config.Server, name string) string {
+	return server.Prefix + walDir + name + ".gz"
+}
+
+// PushWAL archives a WAL file; it is meant to be used as PostgreSQL's
+// archive_command with %p as path and %f as name. Pushing a file that is
+// already archived with identical contents succeeds, as PostgreSQL retries
+// archiving after a crash; different contents are refused. Every
+// destination is checked on its own, so a retry stores the file on the
+// destinations that missed it.
+func (s *Service) PushWAL(serverName, path, name string) error {
+	job := s.snapshot()
+	defer job.release()
+	server, err := job.server(serverName)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read WAL file: %w", err)
+	}
+
+	objectName := walObjectName(server, name)
+	destinations := job.destinations()
+	var missing []string
+	for _, destination := range destinations {
+		existing, err := destination.job.readWAL(objectName)
+		switch {
+		case err == nil && bytes.Equal(existing, data):
+		case err == nil:
+			return fmt.Errorf("WAL file %s is already archived%s with different contents", name, job.onDestination(destination.name))
+		case errors.Is(err, storage.ErrNotFound):
+			missing = append(missing, destination.name)
+		default:
+			return fmt.Errorf("failed to check for archived WAL file %s%s: %w", name, job.onDestination(destination.name), err)
+		}
+	}
+	if len(missing) == 0 {
+		job.logger.Info("WAL file %s is already archived, skipping", name)
+		return nil
+	}
+
+	var compressed bytes.Buffer
+	gzipWriter := gzip.NewWriter(&compressed)
+	if _, err := gzipWriter.Write(data); err != nil {
+		return fmt.Errorf("failed to compress WAL file: %w", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+
+	target := job.storage
+	if multi, ok := job.storage.(*storage.Multi); ok {
+		target = multi.Subset(missing)
+	}
+	compressedSize := compressed.Len()
+	if err := target.Store(objectName, &compressed); err != nil {
+		return fmt.Errorf("failed to store WAL file %s: %w", name, err)
+	}
+
+	if len(missing) < len(destinations) {
+		job.logger.Info("Archived WAL file %s on destinations %s that were missing it (%d bytes, %d compressed)",
+			name, strings.Join(missing, ", "), len(data), compressedSize)
+		return nil
+	}
+	job.logger.Info("Archived WAL file %s (%d bytes, %d compressed)", name, len(data), compressedSize)
+	return nil
+}
+
+// FetchWAL restores an archived WAL file to dest; it is meant to be used as
+// PostgreSQL's restore_command with %f as name and %p as dest. It returns
+// an error wrapping storage.ErrNotFound when the file was never archived,
+// which is the normal end of recovery.
+func (s *Service) FetchWAL(serverName, name, dest string) error {
+	job := s.snapshot()
+	defer job.release()
+	server, err := job.server(serverName)
+	if err != nil {
+		return err
+	}
+
+	data, err := job.readWAL(walObjectName(server, name))
+	if err != nil {
+		return fmt.Errorf("failed to fetch WAL file %s: %w", name, err)
+	}
+
+	// Write to a temporary file first so PostgreSQL never sees a partially
+	// restored segment.
+	tmp := dest + ".pg-backup.tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write WAL file: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write WAL file: %w", err)
+	}
+
+	job.logger.Info("Restored WAL file %s to %s", name, filepath.Clean(dest))
+	return nil
+}
+
+func (s *Service) readWAL(objectName string) ([]byte, error) {
+	reader, err := s.storage.Open(objectName)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", objectName, err)
+	}
+	defer gzipReader.Close()
+
+	return io.ReadAll(gzipReader)
+}
+
+// pruneWAL deletes archived WAL older than the start of the oldest retained
+// base backup. Nothing is deleted unless at least one base backup with
+// known WAL positions is retained, so logical-only servers keep their WAL.
+func (s *Service) pruneWAL(server config.Server, retained []artifact) error {
+	var oldest *PhysicalInfo
+	for _, a := range retained {
+		if a.kind != KindBaseBackup {
+			continue
+		}
+		info, err := s.readPhysicalInfo(a.name)
+		if err != nil {
+			s.logger.Warning("Retention: cannot read WAL positions of %s, keeping all WAL: %v", a.name, err)
+			return nil
+		}
+		if info.StartLSN == "" {
+			s.logger.Warning("Retention: WAL start position of %s is unknown, keeping all WAL", a.name)
+			return nil
+		}
+		oldest = info
+		break
+	}
+	if oldest == nil {
+		return nil
+	}
+
+	segmentSize, err := config.ParseSize(server.WALSegmentSize)
+	if err != nil {
+		return err
+	}
+	startLSN, err := ParseLSN(oldest.StartLSN)
+	if err != nil {
+		return err
+	}
+
+	objects, err := s.storage.List(server.Prefix + walDir)
+	if err != nil {
+		return fmt.Errorf("failed to list WAL: %w", err)
+	}
+
+	deleted, locked := 0, 0
+	for _, object := range objects {
+		name := strings.TrimSuffix(strings.TrimPrefix(object.Name, server.Prefix+walDir), ".gz")
+		timeline, segmentStart, ok := parseSegmentName(name, segmentSize)
+		if !ok || timeline > uint64(oldest.Timeline) {
+			continue
+		}
+		if segmentStart+uint64(segmentSize) > startLSN {
+			continue
+		}
+		err := s.storage.Delete(object.Name)
+		if errors.Is(err, storage.ErrLocked) {
+			locked++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", object.Name, err)
+		}
+		deleted++
+	}
+
+	if deleted > 0 {
+		s.logger.Info("Retention: deleted %d WAL files older than %s (start of %s)", deleted, oldest.StartLSN, oldest.Archive)
+	}
+	if locked > 0 {
+		s.logger.Info("Retention: kept %d locked WAL files older than %s until their locks expire", locked, oldest.StartLSN)
+	}
+	return nil
+}
+
+// ParseLSN parses a log sequence number in PostgreSQL's "X/X" notation.
+func ParseLSN(lsn string) (uint64, error) {
+	high, low, ok := strings.Cut(lsn, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	hi, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	lo, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", lsn)
+	}
+	return hi<<32 | lo, nil
+}
+
+// parseSegmentName returns the timeline and the LSN at which a WAL segment
+// (or a file derived from one) starts.
+func parseSegmentName(name string, segmentSize int64) (uint64, uint64, bool) {
+	match := walSegmentPattern.FindStringSubmatch(name)
+	if match == nil {
+		return 0, 0, false
+	}
+	timeline, _ := strconv.ParseUint(match[1], 16, 32)
+	logID, _ := strconv.ParseUint(match[2], 16, 32)
+	segment, _ := strconv.ParseUint(match[3], 16, 32)
+	return timeline, logID<<32 + segment*uint64(segmentSize), true
+}
+
+// server returns the configured server called name. The name may be empty
+// when only one server is configured.
+func (s *Service) server(name string) (config.Server, error) {
+	servers := s.dbConfig.ServerList()
+	if name == "" {
+		if len(servers) == 1 {
+			return servers[0], nil
+		}
+		return config.Server{}, fmt.Errorf("several servers are configured, select one with -server")
+	}
+	for _, server := range servers {
+		if server.Name == name {
+			return server, nil
+		}
+	}
+	return config.Server{}, fmt.Errorf("server %s is not configured", name)
+}
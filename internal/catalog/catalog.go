@@ -0,0 +1,85 @@
+// Package catalog describes the backups held in storage, as listed by the
+// list-backups and inspect commands and the /backups endpoint.
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnknownServer is returned when a filter selects a server that is not
+// configured.
+var ErrUnknownServer = errors.New("unknown server")
+
+// Entry is one stored backup together with what its manifest and last
+// verification recorded.
+type Entry struct {
+	Name     string    `json:"name"`
+	Server   string    `json:"server"`
+	Database string    `json:"database,omitempty"`
+	Kind     string    `json:"kind"`
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+
+	// The remaining fields come from the manifest and are empty for
+	// backups stored without one.
+	HasManifest   bool     `json:"has_manifest"`
+	SHA256        string   `json:"sha256,omitempty"`
+	RawSize       int64    `json:"raw_size,omitempty"`
+	ToolVersion   string   `json:"tool_version,omitempty"`
+	ServerVersion string   `json:"server_version,omitempty"`
+	Options       []string `json:"options,omitempty"`
+
+	Verification *Verification `json:"verification,omitempty"`
+}
+
+// Verification is the outcome of the last restore verification of a
+// backup.
+type Verification struct {
+	VerifiedAt time.Time `json:"verified_at"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Tables     int       `json:"tables"`
+}
+
+// Filter selects catalog entries. Zero fields match everything.
+type Filter struct {
+	Server   string
+	Database string
+	// Since and Until bound the backup time; Since is inclusive and Until
+	// exclusive.
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether e is selected by the filter.
+func (f Filter) Match(e Entry) bool {
+	if f.Server != "" && e.Server != f.Server {
+		return false
+	}
+	if f.Database != "" && e.Database != f.Database {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// ParseTime accepts RFC 3339, a "2006-01-02 15:04:05" local time or a
+// "2006-01-02" local date.
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339, \"YYYY-MM-DD HH:MM:SS\" or \"YYYY-MM-DD\"", value)
+}
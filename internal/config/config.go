@@ -1,43 +1,309 @@
 package config
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
+type Database struct {
+	Host         string   `yaml:"host"`
+	Port         int      `yaml:"port"`
+	User         string   `yaml:"user"`
+	Password     string   `yaml:"password"`
+	PasswordFile string   `yaml:"password_file"`
+	Databases    []string `yaml:"databases"`
+	// Discovery filters the databases found when Databases is empty.
+	Discovery Discovery `yaml:"discovery"`
+	// DumpOptions holds pg_dump overrides keyed by database name; the "*"
+	// entry applies to databases without their own entry.
+	DumpOptions map[string]DumpOptions `yaml:"dump_options"`
+	// DumpGlobals stores roles, tablespaces and grants (pg_dumpall
+	// --globals-only) next to the per-database dumps. Full dumps already
+	// contain them.
+	DumpGlobals     bool `yaml:"dump_globals"`
+	NoRolePasswords bool `yaml:"no_role_passwords"`
+	// WALSegmentSize must match the cluster's wal_segment_size; it is used
+	// to work out which archived WAL retained base backups still need.
+	WALSegmentSize string `yaml:"wal_segment_size"`
+
+	// TLS settings, applied to both the discovery connection and the
+	// pg_dump/pg_dumpall processes (as PGSSL* environment variables).
+	SSLMode     string `yaml:"sslmode"`
+	SSLRootCert string `yaml:"sslrootcert"`
+	SSLCert     string `yaml:"sslcert"`
+	SSLKey      string `yaml:"sslkey"`
+}
+
+// DumpOptions selects what pg_dump includes for one database. Schema and
+// table values are pg_dump patterns, e.g. "public.audit_*".
+type DumpOptions struct {
+	Schemas          []string `yaml:"schemas"`
+	ExcludeSchemas   []string `yaml:"exclude_schemas"`
+	Tables           []string `yaml:"tables"`
+	ExcludeTables    []string `yaml:"exclude_tables"`
+	ExcludeTableData []string `yaml:"exclude_table_data"`
+	NoOwner          bool     `yaml:"no_owner"`
+	NoPrivileges     bool     `yaml:"no_privileges"`
+	SchemaOnly       bool     `yaml:"schema_only"`
+	DataOnly         bool     `yaml:"data_only"`
+}
+
+// Verification restores the newest backups into a scratch database on a
+// separate server to prove they can be restored.
+type Verification struct {
+	Enabled bool `yaml:"enabled"`
+	// AfterBackup verifies each server's new backups right after a run.
+	AfterBackup bool `yaml:"after_backup"`
+	// Schedule runs verification of the newest backups on its own cron
+	// schedule.
+	Schedule string `yaml:"schedule"`
+	// Server is where scratch databases are created; its user needs the
+	// CREATEDB privilege. The databases list is not used.
+	Server Database `yaml:"server"`
+	// IgnoreErrors lets psql continue past errors (such as missing roles)
+	// instead of failing the verification on the first one.
+	IgnoreErrors bool `yaml:"ignore_errors"`
+	// MinTables fails a verification when fewer user tables are restored.
+	MinTables  int         `yaml:"min_tables"`
+	Assertions []Assertion `yaml:"assertions"`
+}
+
+// Retention is a grandfather-father-son policy. Each keep_* setting keeps
+// the newest backup of that many of the most recent days, weeks, months or
+// years that have backups (keep_last: that many most recent backups),
+// counted separately per database; -1 keeps all of them.
+type Retention struct {
+	KeepLast    int `yaml:"keep_last"`
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+}
+
+// IsSet reports whether any keep_* setting is used, in which case the
+// policy replaces retention_days.
+func (r Retention) IsSet() bool {
+	return r != Retention{}
+}
+
+// Assertion is a query run against a restored database that must return a
+// single true value.
+type Assertion struct {
+	Name string `yaml:"name"`
+	// Database limits the assertion to one database; empty applies it to all.
+	Database string `yaml:"database"`
+	SQL      string `yaml:"sql"`
+}
+
+// Storage is where backups are written.
+type Storage struct {
+	Type  string `yaml:"type"`
+	Local struct {
+		Path string `yaml:"path"`
+		// FileMode and DirMode are octal permissions such as "0640";
+		// they default to 0644 and 0755.
+		FileMode string `yaml:"file_mode"`
+		DirMode  string `yaml:"dir_mode"`
+		// MinFreeSpace, e.g. "5GB", must stay free after a backup is
+		// written; backups of unknown size only check it before writing.
+		MinFreeSpace string `yaml:"min_free_space"`
+	} `yaml:"local"`
+	S3 struct {
+		Bucket        string `yaml:"bucket"`
+		Region        string `yaml:"region"`
+		Endpoint      string `yaml:"endpoint"`
+		AccessKey     string `yaml:"access_key"`
+		AccessKeyFile string `yaml:"access_key_file"`
+		SecretKey     string `yaml:"secret_key"`
+		SecretKeyFile string `yaml:"secret_key_file"`
+		// ForcePathStyle, DisableSSL and CACert are for self-hosted
+		// S3-compatible stores such as MinIO and Ceph RGW.
+		ForcePathStyle bool   `yaml:"force_path_style"`
+		DisableSSL     bool   `yaml:"disable_ssl"`
+		CACert         string `yaml:"ca_cert"`
+		// ServerSideEncryption is sse-s3, sse-kms or sse-c.
+		ServerSideEncryption string `yaml:"server_side_encryption"`
+		KMSKeyID             string `yaml:"kms_key_id"`
+		// SSECustomerKey is the base64-encoded 256-bit key for sse-c.
+		SSECustomerKey      string            `yaml:"sse_customer_key"`
+		SSECustomerKeyFile  string            `yaml:"sse_customer_key_file"`
+		StorageClass        string            `yaml:"storage_class"`
+		Tags                map[string]string `yaml:"tags"`
+		ACL                 string            `yaml:"acl"`
+		ExpectedBucketOwner string            `yaml:"expected_bucket_owner"`
+		ObjectLock          ObjectLock        `yaml:"object_lock"`
+	} `yaml:"s3"`
+	SFTP struct {
+		Host         string `yaml:"host"`
+		Port         int    `yaml:"port"`
+		User         string `yaml:"user"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"password_file"`
+		// PrivateKey is the path of the private key file.
+		PrivateKey               string `yaml:"private_key"`
+		PrivateKeyPassphrase     string `yaml:"private_key_passphrase"`
+		PrivateKeyPassphraseFile string `yaml:"private_key_passphrase_file"`
+		// KnownHosts defaults to ~/.ssh/known_hosts.
+		KnownHosts string `yaml:"known_hosts"`
+		Path       string `yaml:"path"`
+	} `yaml:"sftp"`
+	Azure struct {
+		Account        string `yaml:"account"`
+		AccountKey     string `yaml:"account_key"`
+		AccountKeyFile string `yaml:"account_key_file"`
+		SASToken       string `yaml:"sas_token"`
+		SASTokenFile   string `yaml:"sas_token_file"`
+		Container      string `yaml:"container"`
+		Prefix         string `yaml:"prefix"`
+		// Endpoint overrides https://<account>.blob.core.windows.net.
+		Endpoint   string `yaml:"endpoint"`
+		AccessTier string `yaml:"access_tier"`
+	} `yaml:"azure"`
+	GCS struct {
+		Bucket string `yaml:"bucket"`
+		Prefix string `yaml:"prefix"`
+		// CredentialsFile is a service account key file; it defaults to
+		// $GOOGLE_APPLICATION_CREDENTIALS.
+		CredentialsFile string `yaml:"credentials_file"`
+		StorageClass    string `yaml:"storage_class"`
+		// Endpoint overrides https://storage.googleapis.com.
+		Endpoint string `yaml:"endpoint"`
+	} `yaml:"gcs"`
+	WebDAV struct {
+		URL          string `yaml:"url"`
+		User         string `yaml:"user"`
+		Password     string `yaml:"password"`
+		PasswordFile string `yaml:"password_file"`
+		// CACert is a PEM file trusted in addition to the system roots.
+		CACert string `yaml:"ca_cert"`
+	} `yaml:"webdav"`
+}
+
+// ObjectLock makes uploaded S3 objects immutable. The bucket must have
+// Object Lock enabled.
+type ObjectLock struct {
+	// Mode is governance or compliance; empty disables retention locks.
+	Mode string `yaml:"mode"`
+	// RetainDays defaults to the destination's retention_days.
+	RetainDays int  `yaml:"retain_days"`
+	LegalHold  bool `yaml:"legal_hold"`
+}
+
+// Destination is one of several storages every backup is written to. Its
+// retention settings default to the top-level ones; retention_days -1 keeps
+// every backup on the destination instead.
+type Destination struct {
+	Name          string `yaml:"name"`
+	Storage       `yaml:",inline"`
+	RetentionDays int       `yaml:"retention_days"`
+	Retention     Retention `yaml:"retention"`
+}
+
+// Server is one PostgreSQL cluster to back up. Backups of a named server are
+// stored under "<name>/" so several clusters can share one destination.
+type Server struct {
+	Name     string `yaml:"name"`
+	Database `yaml:",inline"`
+	FullDump bool `yaml:"full_dump"`
+	// Mode is "logical" (pg_dump/pg_dumpall, the default) or "physical"
+	// (pg_basebackup of the whole cluster).
+	Mode string `yaml:"mode"`
+	// Schedule overrides the top-level schedule for this server.
+	Schedule string `yaml:"schedule"`
+
+	// Prefix is prepended to every object name stored for this server by
+	// the default naming, and to its archived WAL.
+	Prefix string `yaml:"-"`
+	// Naming is the naming in effect for the server's backups, with the
+	// default template filled in.
+	Naming Naming `yaml:"-"`
+}
+
+// Naming decides where backups are stored and what they are called.
+type Naming struct {
+	// Template builds backup object names from placeholders, e.g.
+	// "{server}/{database}/{yyyy}/{mm}/{database}_{timestamp}.{ext}". The
+	// default is "{database}_{timestamp}.{ext}", under "<server>/" for each
+	// entry of a servers list.
+	Template string `yaml:"template"`
+	// Prefix is prepended to every stored object, WAL included.
+	Prefix string `yaml:"prefix"`
+	// TimeZone is the zone name timestamps are written in: local (the
+	// default) or utc.
+	TimeZone string `yaml:"timezone"`
+}
+
+// Naming template placeholders. {database} is the database name, or the
+// kind for server-wide backups (full_dump, globals or basebackup); {kind}
+// is database, full_dump, globals or basebackup; {ext} is sql.gz or tar.gz.
+var namingPlaceholders = []string{"server", "database", "kind", "timestamp", "yyyy", "mm", "dd", "ext"}
+
+// Naming time zones.
+const (
+	TimeZoneLocal = "local"
+	TimeZoneUTC   = "utc"
+)
+
+const defaultNameTemplate = "{database}_{timestamp}.{ext}"
+
+// reservedDatabaseNames stand in for the database name of server-wide
+// backups, so backups of a database with one of these names could not be
+// told apart from them.
+var reservedDatabaseNames = []string{"full_dump", "globals", "basebackup"}
+
+// IsReservedDatabaseName reports whether name is used for server-wide
+// backups and cannot be backed up as a database.
+func IsReservedDatabaseName(name string) bool {
+	return slices.Contains(reservedDatabaseNames, name)
+}
+
 type Config struct {
-	Database struct {
-		Host      string   `yaml:"host"`
-		Port      int      `yaml:"port"`
-		User      string   `yaml:"user"`
-		Password  string   `yaml:"password"`
-		Databases []string `yaml:"databases"`
-	} `yaml:"database"`
-
-	Storage struct {
-		Type  string `yaml:"type"`
-		Local struct {
-			Path string `yaml:"path"`
-		} `yaml:"local"`
-		S3 struct {
-			Bucket    string `yaml:"bucket"`
-			Region    string `yaml:"region"`
-			Endpoint  string `yaml:"endpoint"`
-			AccessKey string `yaml:"access_key"`
-			SecretKey string `yaml:"secret_key"`
-		} `yaml:"s3"`
-	} `yaml:"storage"`
-
-	Schedule        string `yaml:"schedule"`
-	LogFile         string `yaml:"log_file"`
-	RunOnStart      bool   `yaml:"run_on_start"`
+	Database Database `yaml:"database"`
+	Servers  []Server `yaml:"servers"`
+
+	Storage      Storage       `yaml:"storage"`
+	Destinations []Destination `yaml:"destinations"`
+	// DestinationPolicy decides when a backup counts as stored: "all"
+	// destinations (the default) or "any" of them.
+	DestinationPolicy string `yaml:"destination_policy"`
+
+	Verification Verification `yaml:"verification"`
+	Naming       Naming       `yaml:"naming"`
+
+	Schedule   string `yaml:"schedule"`
+	LogFile    string `yaml:"log_file"`
+	RunOnStart bool   `yaml:"run_on_start"`
+	// RetentionDays deletes backups older than this many days; 0 (the
+	// default) or -1 keeps them forever unless a Retention policy is set.
 	RetentionDays   int    `yaml:"retention_days"`
 	HealthCheckPort int    `yaml:"health_check_port"`
 	FullDump        bool   `yaml:"full_dump"`
+	Mode            string `yaml:"mode"`
+
+	Retention Retention `yaml:"retention"`
 }
 
+// Destination policies.
+const (
+	DestinationPolicyAll = "all"
+	DestinationPolicyAny = "any"
+)
+
+// Backup modes.
+const (
+	ModeLogical  = "logical"
+	ModePhysical = "physical"
+)
+
 func Load(filename string) (*Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -45,54 +311,243 @@ func Load(filename string) (*Config, error) {
 	}
 
 	var config Config
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	var problems []string
+
+	// Unknown keys are rejected so that a typo such as "shedule" is reported
+	// instead of silently falling back to a default.
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+		problems = append(problems, typeErr.Errors...)
 	}
 
 	setDefaults(&config)
 
-	if err := validate(&config); err != nil {
-		return nil, fmt.Errorf("config validation failed: %w", err)
+	if err := loadSecrets(&config); err != nil {
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	problems = append(problems, validate(&config)...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
 	}
 
 	return &config, nil
 }
 
+// DefaultServerName is used for the server described by the top-level
+// database section when no servers list is configured.
+const DefaultServerName = "default"
+
+// ServerList returns the servers to back up. Without a servers list the
+// top-level database section and full_dump flag describe a single server,
+// whose backups stay in the storage root (or under the naming prefix) as
+// before.
+func (c *Config) ServerList() []Server {
+	naming := c.Naming
+	if naming.Template == "" {
+		naming.Template = defaultNameTemplate
+		if len(c.Servers) > 0 {
+			naming.Template = "{server}/" + defaultNameTemplate
+		}
+	}
+	if naming.TimeZone == "" {
+		naming.TimeZone = TimeZoneLocal
+	}
+
+	if len(c.Servers) == 0 {
+		return []Server{{
+			Name:     DefaultServerName,
+			Database: c.Database,
+			FullDump: c.FullDump,
+			Mode:     c.Mode,
+			Prefix:   naming.Prefix,
+			Naming:   naming,
+		}}
+	}
+
+	servers := make([]Server, len(c.Servers))
+	for i, server := range c.Servers {
+		server.Prefix = naming.Prefix + server.Name + "/"
+		server.Naming = naming
+		servers[i] = server
+	}
+	return servers
+}
+
+// DestinationList returns the storages backups are written to. A
+// configuration with a single storage section has one destination called
+// "default". Destinations without retention settings of their own inherit
+// the top-level ones.
+func (c *Config) DestinationList() []Destination {
+	if len(c.Destinations) == 0 {
+		return []Destination{{
+			Name:          DefaultServerName,
+			Storage:       c.Storage,
+			RetentionDays: c.RetentionDays,
+			Retention:     c.Retention,
+		}}
+	}
+
+	destinations := make([]Destination, len(c.Destinations))
+	for i, destination := range c.Destinations {
+		if destination.RetentionDays == 0 && !destination.Retention.IsSet() {
+			destination.RetentionDays = c.RetentionDays
+			destination.Retention = c.Retention
+		}
+		destinations[i] = destination
+	}
+	return destinations
+}
+
+// ObjectLockDays returns how long uploads to the destination are locked:
+// the object lock's retain_days, or else the destination's retention_days
+// so backups become deletable when retention would delete them.
+func (d Destination) ObjectLockDays() int {
+	if d.S3.ObjectLock.RetainDays > 0 {
+		return d.S3.ObjectLock.RetainDays
+	}
+	return d.RetentionDays
+}
+
+// ScheduleFor returns the cron schedule that applies to server.
+func (c *Config) ScheduleFor(server Server) string {
+	if server.Schedule != "" {
+		return server.Schedule
+	}
+	return c.Schedule
+}
+
 func setDefaults(config *Config) {
-	if config.Database.Port == 0 {
-		config.Database.Port = 5432
+	setDatabaseDefaults(&config.Database)
+	setDatabaseDefaults(&config.Verification.Server)
+	if config.Mode == "" {
+		config.Mode = ModeLogical
 	}
-	if config.RetentionDays == 0 {
-		config.RetentionDays = 30
+	for i := range config.Servers {
+		setDatabaseDefaults(&config.Servers[i].Database)
+		if config.Servers[i].Mode == "" {
+			config.Servers[i].Mode = ModeLogical
+		}
 	}
 	if config.HealthCheckPort == 0 {
 		config.HealthCheckPort = 8080
 	}
+	if config.DestinationPolicy == "" {
+		config.DestinationPolicy = DestinationPolicyAll
+	}
+	setStorageDefaults(&config.Storage)
+	for i := range config.Destinations {
+		setStorageDefaults(&config.Destinations[i].Storage)
+	}
 }
 
-func validate(config *Config) error {
-	if config.Database.Host == "" {
-		return fmt.Errorf("database host is required")
+func setStorageDefaults(storage *Storage) {
+	if storage.Type == "sftp" && storage.SFTP.Port == 0 {
+		storage.SFTP.Port = 22
 	}
-	if config.Database.User == "" {
-		return fmt.Errorf("database user is required")
+}
+
+func setDatabaseDefaults(db *Database) {
+	if db.Port == 0 {
+		db.Port = 5432
+	}
+	if db.WALSegmentSize == "" {
+		db.WALSegmentSize = "16MB"
 	}
-	if config.Storage.Type == "" {
-		return fmt.Errorf("storage type is required")
+	if db.SSLMode == "" {
+		// Same default as libpq: use TLS when the server offers it.
+		db.SSLMode = "prefer"
 	}
-	if config.Storage.Type == "local" && config.Storage.Local.Path == "" {
-		return fmt.Errorf("local storage path is required")
+}
+
+// loadSecrets fills in credentials that are configured as *_file options,
+// as used with Docker and Kubernetes secrets. A value set inline takes
+// precedence over its file. Every file that cannot be read is reported.
+func loadSecrets(config *Config) error {
+	secrets := []secret{
+		{&config.Database.Password, config.Database.PasswordFile, "database password_file"},
+		{&config.Verification.Server.Password, config.Verification.Server.PasswordFile, "verification server password_file"},
 	}
-	if config.Storage.Type == "s3" && (config.Storage.S3.Bucket == "" || config.Storage.S3.Endpoint == "" || config.Storage.S3.AccessKey == "" || config.Storage.S3.SecretKey == "") {
-		return fmt.Errorf("s3 bucket, endpoint, access key and secret key are required")
+	secrets = append(secrets, storageSecrets("", &config.Storage)...)
+
+	for i := range config.Servers {
+		server := &config.Servers[i]
+		secrets = append(secrets, secret{&server.Password, server.PasswordFile, fmt.Sprintf("servers[%d] password_file", i)})
 	}
-	if config.Schedule == "" {
-		return fmt.Errorf("schedule is required")
+	for i := range config.Destinations {
+		secrets = append(secrets, storageSecrets(fmt.Sprintf("destinations[%d] ", i), &config.Destinations[i].Storage)...)
 	}
-	if config.LogFile == "" {
-		return fmt.Errorf("log file is required")
+
+	var errs []error
+	for _, secret := range secrets {
+		if *secret.value != "" || secret.file == "" {
+			continue
+		}
+		data, err := os.ReadFile(secret.file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to read %s: %w", secret.name, err))
+			continue
+		}
+		*secret.value = strings.TrimRight(string(data), "\r\n")
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// secret is a value that may be read from a file.
+type secret struct {
+	value *string
+	file  string
+	name  string
+}
+
+func storageSecrets(label string, storage *Storage) []secret {
+	return []secret{
+		{&storage.S3.AccessKey, storage.S3.AccessKeyFile, label + "s3 access_key_file"},
+		{&storage.S3.SecretKey, storage.S3.SecretKeyFile, label + "s3 secret_key_file"},
+		{&storage.S3.SSECustomerKey, storage.S3.SSECustomerKeyFile, label + "s3 sse_customer_key_file"},
+		{&storage.SFTP.Password, storage.SFTP.PasswordFile, label + "sftp password_file"},
+		{&storage.SFTP.PrivateKeyPassphrase, storage.SFTP.PrivateKeyPassphraseFile, label + "sftp private_key_passphrase_file"},
+		{&storage.Azure.AccountKey, storage.Azure.AccountKeyFile, label + "azure account_key_file"},
+		{&storage.Azure.SASToken, storage.Azure.SASTokenFile, label + "azure sas_token_file"},
+		{&storage.WebDAV.Password, storage.WebDAV.PasswordFile, label + "webdav password_file"},
+	}
+}
+
+// DumpOptionsFor returns the pg_dump options configured for database.
+func (d *Database) DumpOptionsFor(database string) DumpOptions {
+	if options, ok := d.DumpOptions[database]; ok {
+		return options
+	}
+	return d.DumpOptions["*"]
+}
+
+// PasswordFor returns the password to use when connecting to database.
+// An explicit password (or password_file) wins; otherwise the entry is
+// looked up in the PostgreSQL password file (PGPASSFILE or ~/.pgpass).
+func (d *Database) PasswordFor(database string) string {
+	if d.Password != "" {
+		return d.Password
+	}
+	return lookupPgpass(d.Host, d.Port, database, d.User)
+}
+
+// ParseFileMode parses octal permissions such as "0640". An empty string is
+// zero, leaving the default in place.
+func ParseFileMode(mode string) (fs.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return 0, fmt.Errorf("invalid permissions %q (expected octal such as 0640)", mode)
+	}
+	return fs.FileMode(value), nil
 }
@@ -0,0 +1,28 @@
+package config
+
+import "testing"
+
+func TestDestinationList(t *testing.T) {
+	gfs := Retention{KeepDaily: 7}
+	tests := []struct {
+		name        string
+		destination Destination
+		wantDays    int
+		want        Retention
+	}{
+		{"inherits", Destination{Name: "plain"}, 30, Retention{}},
+		{"own days", Destination{Name: "days", RetentionDays: 90}, 90, Retention{}},
+		{"own policy", Destination{Name: "gfs", Retention: gfs}, 0, gfs},
+		{"keep all", Destination{Name: "archive", RetentionDays: -1}, -1, Retention{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{RetentionDays: 30, Destinations: []Destination{tt.destination}}
+			got := config.DestinationList()[0]
+			if got.RetentionDays != tt.wantDays || got.Retention != tt.want {
+				t.Errorf("retention = %d days, %+v; want %d days, %+v", got.RetentionDays, got.Retention, tt.wantDays, tt.want)
+			}
+		})
+	}
+}
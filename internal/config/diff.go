@@ -0,0 +1,134 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff describes the settings that differ between two configurations, one
+// line per changed key using the YAML key path. Secret values are never
+// printed.
+func Diff(old, new *Config) []string {
+	before := flatten(old)
+	after := flatten(new)
+
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, key := range sorted {
+		oldValue, hadOld := before[key]
+		newValue, hasNew := after[key]
+		if hadOld && hasNew && oldValue == newValue {
+			continue
+		}
+		if isSecretKey(key) {
+			changes = append(changes, fmt.Sprintf("%s: changed", key))
+			continue
+		}
+		switch {
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("%s: set to %s", key, newValue))
+		case !hasNew:
+			changes = append(changes, fmt.Sprintf("%s: removed (was %s)", key, oldValue))
+		default:
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, oldValue, newValue))
+		}
+	}
+
+	return changes
+}
+
+func isSecretKey(key string) bool {
+	name := key[strings.LastIndex(key, ".")+1:]
+	if strings.HasSuffix(name, "_file") {
+		return false
+	}
+	return strings.Contains(name, "password") || strings.Contains(name, "secret") || strings.Contains(name, "key") || strings.Contains(name, "token")
+}
+
+// flatten maps every leaf setting to its dotted YAML path.
+func flatten(config *Config) map[string]string {
+	values := make(map[string]string)
+	if config != nil {
+		flattenValue("", reflect.ValueOf(*config), values)
+	}
+	return values
+}
+
+func flattenValue(prefix string, v reflect.Value, values map[string]string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, inline := yamlName(field)
+			if name == "-" {
+				continue
+			}
+			key := prefix
+			if !inline {
+				key = joinKey(prefix, name)
+			}
+			flattenValue(key, v.Field(i), values)
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Len() == 0 {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			flattenValue(fmt.Sprintf("%s[%d]", prefix, i), v.Index(i), values)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		for _, k := range keys {
+			flattenValue(joinKey(prefix, fmt.Sprint(k.Interface())), v.MapIndex(k), values)
+		}
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			flattenValue(prefix, v.Elem(), values)
+		}
+	default:
+		if !v.IsZero() {
+			values[prefix] = fmt.Sprintf("%v", v.Interface())
+		}
+	}
+}
+
+func yamlName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("yaml")
+	parts := strings.Split(tag, ",")
+	inline := false
+	for _, option := range parts[1:] {
+		if option == "inline" {
+			inline = true
+		}
+	}
+	if parts[0] == "" {
+		return strings.ToLower(field.Name), inline
+	}
+	return parts[0], inline
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Discovery narrows down the databases found when no explicit databases
+// list is configured.
+type Discovery struct {
+	// Include and Exclude hold glob patterns ("app_*") or regular
+	// expressions wrapped in slashes ("/^ci_[0-9]+$/").
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// IncludePostgres opts the "postgres" maintenance database back in.
+	IncludePostgres bool `yaml:"include_postgres"`
+	// MinSize and MaxSize bound the database size, e.g. "10MB" or "2GB".
+	MinSize string `yaml:"min_size"`
+	MaxSize string `yaml:"max_size"`
+	// Owners limits discovery to databases owned by one of these roles.
+	Owners []string `yaml:"owners"`
+}
+
+// CompilePattern turns a discovery pattern into a matcher. Patterns wrapped
+// in slashes are regular expressions, anything else is a glob.
+func CompilePattern(pattern string) (func(string) bool, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	}, nil
+}
+
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ParseSize parses a size such as "512MB" using binary units. An empty
+// string is zero.
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+
+	i := strings.IndexFunc(size, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i == -1 {
+		i = len(size)
+	}
+	number, unit := size[:i], strings.TrimSpace(size[i:])
+
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q", unit)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func validateDiscovery(d Discovery) []string {
+	var problems []string
+	for _, patterns := range [][]string{d.Include, d.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := CompilePattern(pattern); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid discovery pattern %q: %v", pattern, err))
+			}
+		}
+	}
+
+	minSize, err := ParseSize(d.MinSize)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("invalid discovery min_size: %v", err))
+	}
+	maxSize, err := ParseSize(d.MaxSize)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("invalid discovery max_size: %v", err))
+	}
+	if maxSize > 0 && minSize > maxSize {
+		problems = append(problems, "discovery min_size is larger than max_size")
+	}
+	return problems
+}
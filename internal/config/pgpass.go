@@ -0,0 +1,93 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// lookupPgpass finds a password in the PostgreSQL password file using the
+// same rules as libpq: PGPASSFILE overrides ~/.pgpass, the first matching
+// line wins, "*" matches any value and the file is ignored when it is
+// readable by group or others.
+func lookupPgpass(host string, port int, database, user string) string {
+	path := os.Getenv("PGPASSFILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		path = filepath.Join(home, ".pgpass")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return ""
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	want := []string{host, strconv.Itoa(port), database, user}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+		if pgpassMatches(fields[:4], want) {
+			return fields[4]
+		}
+	}
+
+	return ""
+}
+
+func pgpassMatches(fields, want []string) bool {
+	for i, field := range fields {
+		if field == "*" {
+			continue
+		}
+		if field != want[i] {
+			// libpq treats "localhost" as matching a Unix socket connection
+			if i == 0 && field == "localhost" && strings.HasPrefix(want[i], "/") {
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// splitPgpassLine splits a line on unescaped colons, honouring the \: and
+// \\ escapes allowed by the pgpass format.
+func splitPgpassLine(line string) []string {
+	var fields []string
+	var current strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			current.WriteByte(line[i])
+		case line[i] == ':' && len(fields) < 4:
+			fields = append(fields, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(line[i])
+		}
+	}
+	return append(fields, current.String())
+}
@@ -0,0 +1,511 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ValidationError lists every problem found in a configuration file so they
+// can all be fixed in one go rather than one restart at a time.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "config validation failed: " + strings.Join(e.Problems, "; ")
+}
+
+func validate(config *Config) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(config.Servers) == 0 {
+		problems = append(problems, validateDatabase("database", config.Database)...)
+		problems = append(problems, validateMode("", config.Mode, config.FullDump)...)
+	} else {
+		if config.Database.Host != "" || len(config.Database.Databases) > 0 {
+			addf("database and servers cannot both be configured; move the database section into servers")
+		}
+		names := make(map[string]bool)
+		for i, server := range config.Servers {
+			label := fmt.Sprintf("servers[%d]", i)
+			switch {
+			case server.Name == "":
+				addf("%s name is required", label)
+			case strings.ContainsAny(server.Name, "/\\") || server.Name == "." || server.Name == "..":
+				addf("%s name %q must not contain path separators", label, server.Name)
+			case names[server.Name]:
+				addf("%s name %q is used more than once", label, server.Name)
+			}
+			names[server.Name] = true
+			problems = append(problems, validateDatabase(label, server.Database)...)
+			problems = append(problems, validateMode(label+" ", server.Mode, server.FullDump)...)
+			if server.Schedule != "" {
+				if _, err := cron.ParseStandard(server.Schedule); err != nil {
+					addf("%s invalid schedule %q: %v", label, server.Schedule, err)
+				}
+			}
+		}
+	}
+
+	if len(config.Destinations) == 0 {
+		problems = append(problems, validateStorage("", config.Storage)...)
+	} else {
+		if config.Storage.Type != "" {
+			addf("storage and destinations cannot both be configured; move the storage section into destinations")
+		}
+		names := make(map[string]bool)
+		for i, destination := range config.Destinations {
+			label := fmt.Sprintf("destinations[%d]", i)
+			switch {
+			case destination.Name == "":
+				addf("%s name is required", label)
+			case names[destination.Name]:
+				addf("%s name %q is used more than once", label, destination.Name)
+			}
+			names[destination.Name] = true
+			problems = append(problems, validateStorage(label+" ", destination.Storage)...)
+			problems = append(problems, validateRetention(label+" ", destination.RetentionDays, destination.Retention)...)
+		}
+	}
+	switch config.DestinationPolicy {
+	case DestinationPolicyAll, DestinationPolicyAny:
+	default:
+		addf("invalid destination_policy %q (expected all or any)", config.DestinationPolicy)
+	}
+
+	if config.Schedule == "" {
+		addf("schedule is required")
+	} else if _, err := cron.ParseStandard(config.Schedule); err != nil {
+		addf("invalid schedule %q: %v", config.Schedule, err)
+	}
+	if config.Verification.Enabled {
+		problems = append(problems, validateVerification(config.Verification)...)
+	}
+	if config.LogFile == "" {
+		addf("log file is required")
+	}
+	problems = append(problems, validateRetention("", config.RetentionDays, config.Retention)...)
+	problems = append(problems, validateNaming(config.Naming, len(config.Servers))...)
+	for i, destination := range config.DestinationList() {
+		label := ""
+		if len(config.Destinations) > 0 {
+			label = fmt.Sprintf("destinations[%d] ", i)
+		}
+		if destination.Type == "s3" && destination.S3.ObjectLock.Mode != "" && destination.ObjectLockDays() <= 0 {
+			addf("%ss3 object_lock needs retain_days when retention_days is not positive", label)
+		}
+	}
+	if !validPort(config.HealthCheckPort) {
+		addf("health_check_port %d is out of range (1-65535)", config.HealthCheckPort)
+	}
+
+	return problems
+}
+
+func validateDatabase(label string, db Database) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(label+" "+format, args...))
+	}
+
+	if db.Host == "" {
+		addf("host is required")
+	}
+	if !validPort(db.Port) {
+		addf("port %d is out of range (1-65535)", db.Port)
+	}
+	if db.User == "" {
+		addf("user is required")
+	}
+	for i, name := range db.Databases {
+		if strings.TrimSpace(name) == "" {
+			addf("database name at databases[%d] is empty", i)
+		} else if IsReservedDatabaseName(name) {
+			addf("database %s cannot be backed up: its backups would be taken for the server's %s backups", name, name)
+		}
+	}
+
+	for _, problem := range validateDiscovery(db.Discovery) {
+		addf("%s", problem)
+	}
+
+	if size, err := ParseSize(db.WALSegmentSize); err != nil {
+		addf("invalid wal_segment_size: %v", err)
+	} else if size < 1<<20 || size > 1<<30 || size&(size-1) != 0 {
+		addf("wal_segment_size must be a power of two between 1MB and 1GB")
+	}
+
+	if db.NoRolePasswords && !db.DumpGlobals {
+		addf("no_role_passwords requires dump_globals")
+	}
+
+	var dumpOptionNames []string
+	for name := range db.DumpOptions {
+		dumpOptionNames = append(dumpOptionNames, name)
+	}
+	sort.Strings(dumpOptionNames)
+	for _, name := range dumpOptionNames {
+		options := db.DumpOptions[name]
+		if options.SchemaOnly && options.DataOnly {
+			addf("dump_options %s: schema_only and data_only cannot both be set", name)
+		}
+		for _, patterns := range [][]string{options.Schemas, options.ExcludeSchemas, options.Tables, options.ExcludeTables, options.ExcludeTableData} {
+			for _, pattern := range patterns {
+				if strings.TrimSpace(pattern) == "" {
+					addf("dump_options %s: empty schema or table pattern", name)
+				}
+			}
+		}
+	}
+
+	switch db.SSLMode {
+	case "disable", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		addf("invalid sslmode %q (expected disable, prefer, require, verify-ca or verify-full)", db.SSLMode)
+	}
+	if (db.SSLCert == "") != (db.SSLKey == "") {
+		addf("sslcert and sslkey must be set together")
+	}
+	for _, file := range []struct{ name, path string }{
+		{"sslrootcert", db.SSLRootCert},
+		{"sslcert", db.SSLCert},
+		{"sslkey", db.SSLKey},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			addf("%s: %v", file.name, err)
+		}
+	}
+
+	return problems
+}
+
+func validateVerification(v Verification) []string {
+	problems := validateDatabase("verification server", v.Server)
+	if !v.AfterBackup && v.Schedule == "" {
+		problems = append(problems, "verification needs after_backup or a schedule")
+	}
+	if v.Schedule != "" {
+		if _, err := cron.ParseStandard(v.Schedule); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid verification schedule %q: %v", v.Schedule, err))
+		}
+	}
+	if v.MinTables < 0 {
+		problems = append(problems, "verification min_tables must not be negative")
+	}
+	for i, assertion := range v.Assertions {
+		if strings.TrimSpace(assertion.SQL) == "" {
+			problems = append(problems, fmt.Sprintf("verification assertions[%d] sql is required", i))
+		}
+	}
+	return problems
+}
+
+func validateStorage(label string, storage Storage) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, label+fmt.Sprintf(format, args...))
+	}
+
+	switch storage.Type {
+	case "":
+		addf("storage type is required")
+	case "local":
+		if storage.Local.Path == "" {
+			addf("local storage path is required")
+		}
+		for _, mode := range []struct{ name, value string }{
+			{"file_mode", storage.Local.FileMode},
+			{"dir_mode", storage.Local.DirMode},
+		} {
+			if _, err := ParseFileMode(mode.value); err != nil {
+				addf("local %s: %v", mode.name, err)
+			}
+		}
+		if _, err := ParseSize(storage.Local.MinFreeSpace); err != nil {
+			addf("local min_free_space: %v", err)
+		}
+	case "s3":
+		if storage.S3.Bucket == "" {
+			addf("s3 bucket is required")
+		}
+		if storage.S3.Endpoint == "" {
+			addf("s3 endpoint is required")
+		}
+		if (storage.S3.AccessKey == "") != (storage.S3.SecretKey == "") {
+			addf("s3 access key and secret key must be set together")
+		}
+		problems = append(problems, validateS3Upload(label, storage)...)
+	case "sftp":
+		if storage.SFTP.Host == "" {
+			addf("sftp host is required")
+		}
+		if !validPort(storage.SFTP.Port) {
+			addf("sftp port %d is out of range (1-65535)", storage.SFTP.Port)
+		}
+		if storage.SFTP.User == "" {
+			addf("sftp user is required")
+		}
+		if storage.SFTP.Password == "" && storage.SFTP.PrivateKey == "" {
+			addf("sftp needs a password or a private_key")
+		}
+		if storage.SFTP.Path == "" {
+			addf("sftp path is required")
+		}
+		for _, file := range []struct{ name, path string }{
+			{"private_key", storage.SFTP.PrivateKey},
+			{"known_hosts", storage.SFTP.KnownHosts},
+		} {
+			if file.path == "" {
+				continue
+			}
+			if _, err := os.Stat(file.path); err != nil {
+				addf("sftp %s: %v", file.name, err)
+			}
+		}
+	case "azure":
+		if storage.Azure.Account == "" {
+			addf("azure account is required")
+		}
+		if storage.Azure.Container == "" {
+			addf("azure container is required")
+		}
+		if (storage.Azure.AccountKey == "") == (storage.Azure.SASToken == "") {
+			addf("azure needs exactly one of account_key and sas_token")
+		}
+		if storage.Azure.AccountKey != "" {
+			if _, err := base64.StdEncoding.DecodeString(storage.Azure.AccountKey); err != nil {
+				addf("azure account_key is not valid base64")
+			}
+		}
+		switch storage.Azure.AccessTier {
+		case "", "Hot", "Cool", "Cold", "Archive":
+		default:
+			addf("invalid azure access_tier %q (expected Hot, Cool, Cold or Archive)", storage.Azure.AccessTier)
+		}
+	case "gcs":
+		if storage.GCS.Bucket == "" {
+			addf("gcs bucket is required")
+		}
+		switch storage.GCS.StorageClass {
+		case "", "STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE":
+		default:
+			addf("invalid gcs storage_class %q (expected STANDARD, NEARLINE, COLDLINE or ARCHIVE)", storage.GCS.StorageClass)
+		}
+		switch {
+		case storage.GCS.CredentialsFile != "":
+			if _, err := os.Stat(storage.GCS.CredentialsFile); err != nil {
+				addf("gcs credentials_file: %v", err)
+			}
+		case os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" && storage.GCS.Endpoint == "":
+			addf("gcs credentials_file is required when $GOOGLE_APPLICATION_CREDENTIALS is not set")
+		}
+	case "webdav":
+		if storage.WebDAV.URL == "" {
+			addf("webdav url is required")
+		} else if u, err := url.Parse(storage.WebDAV.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addf("webdav url %q must be an http:// or https:// URL", storage.WebDAV.URL)
+		}
+		if storage.WebDAV.Password != "" && storage.WebDAV.User == "" {
+			addf("webdav password is set without a user")
+		}
+		if storage.WebDAV.CACert != "" {
+			if _, err := os.Stat(storage.WebDAV.CACert); err != nil {
+				addf("webdav ca_cert: %v", err)
+			}
+		}
+	default:
+		addf("invalid storage type %q (expected local, s3, sftp, azure, gcs or webdav)", storage.Type)
+	}
+	return problems
+}
+
+// s3StorageClasses and s3ACLs are the values S3 accepts for uploads.
+var (
+	s3StorageClasses = []string{
+		"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING",
+		"GLACIER", "GLACIER_IR", "DEEP_ARCHIVE", "OUTPOSTS", "SNOW", "EXPRESS_ONEZONE",
+	}
+	s3ACLs = []string{
+		"private", "public-read", "public-read-write", "authenticated-read",
+		"aws-exec-read", "bucket-owner-read", "bucket-owner-full-control",
+	}
+)
+
+func validateS3Upload(label string, storage Storage) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, label+fmt.Sprintf(format, args...))
+	}
+
+	options := storage.S3
+	switch options.ServerSideEncryption {
+	case "", "sse-s3", "sse-kms", "sse-c":
+	default:
+		addf("invalid s3 server_side_encryption %q (expected sse-s3, sse-kms or sse-c)", options.ServerSideEncryption)
+	}
+	if options.KMSKeyID != "" && options.ServerSideEncryption != "sse-kms" {
+		addf("s3 kms_key_id requires server_side_encryption sse-kms")
+	}
+	if options.ServerSideEncryption == "sse-c" {
+		key, err := base64.StdEncoding.DecodeString(options.SSECustomerKey)
+		if err != nil || len(key) != 32 {
+			addf("s3 sse-c needs sse_customer_key set to a base64-encoded 32-byte key")
+		}
+		if strings.HasPrefix(options.Endpoint, "http://") || options.DisableSSL {
+			addf("s3 sse-c requires an https endpoint")
+		}
+	} else if options.SSECustomerKey != "" {
+		addf("s3 sse_customer_key requires server_side_encryption sse-c")
+	}
+	if options.StorageClass != "" && !slices.Contains(s3StorageClasses, options.StorageClass) {
+		addf("invalid s3 storage_class %q (expected one of %s)", options.StorageClass, strings.Join(s3StorageClasses, ", "))
+	}
+	if options.ACL != "" && !slices.Contains(s3ACLs, options.ACL) {
+		addf("invalid s3 acl %q (expected one of %s)", options.ACL, strings.Join(s3ACLs, ", "))
+	}
+	if options.CACert != "" {
+		if _, err := os.Stat(options.CACert); err != nil {
+			addf("s3 ca_cert: %v", err)
+		}
+		if options.DisableSSL || strings.HasPrefix(options.Endpoint, "http://") {
+			addf("s3 ca_cert has no effect on a plain http endpoint")
+		}
+	}
+	switch options.ObjectLock.Mode {
+	case "", "governance", "compliance":
+	default:
+		addf("invalid s3 object_lock mode %q (expected governance or compliance)", options.ObjectLock.Mode)
+	}
+	if options.ObjectLock.RetainDays < 0 {
+		addf("s3 object_lock retain_days cannot be negative")
+	}
+	if options.ObjectLock.RetainDays > 0 && options.ObjectLock.Mode == "" {
+		addf("s3 object_lock retain_days requires a mode")
+	}
+	if len(options.Tags) > 10 {
+		addf("s3 allows at most 10 tags per object, %d are set", len(options.Tags))
+	}
+	for key, value := range options.Tags {
+		if key == "" || len(key) > 128 || len(value) > 256 {
+			addf("s3 tag %q: keys must be 1-128 and values at most 256 characters", key)
+		}
+	}
+	return problems
+}
+
+func validateRetention(label string, days int, retention Retention) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, label+fmt.Sprintf(format, args...))
+	}
+
+	if days < -1 {
+		addf("retention_days must be -1 (keep all), 0 (unused) or a positive number")
+	}
+	if !retention.IsSet() {
+		return problems
+	}
+	if days != 0 {
+		addf("retention_days and retention cannot be used together")
+	}
+	for _, keep := range []struct {
+		name  string
+		value int
+	}{
+		{"keep_last", retention.KeepLast},
+		{"keep_daily", retention.KeepDaily},
+		{"keep_weekly", retention.KeepWeekly},
+		{"keep_monthly", retention.KeepMonthly},
+		{"keep_yearly", retention.KeepYearly},
+	} {
+		if keep.value < -1 {
+			addf("retention %s must be -1 (keep all), 0 (unused) or a positive number", keep.name)
+		}
+	}
+	return problems
+}
+
+var namingPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// serverSegment matches a {server} placeholder that is a complete folder
+// name. Without one, the backups of a server named "prod" could not be told
+// from those of "prod_eu".
+var serverSegment = regexp.MustCompile(`(^|/)\{server\}/`)
+
+// validateNaming checks that the naming template produces names that can be
+// parsed back: every backup needs a distinct name and names of different
+// servers must not be confused with one another.
+func validateNaming(naming Naming, servers int) []string {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if template := naming.Template; template != "" {
+		used := make(map[string]bool)
+		for _, match := range namingPlaceholder.FindAllStringSubmatch(template, -1) {
+			if !slices.Contains(namingPlaceholders, match[1]) {
+				addf("naming template has unknown placeholder {%s} (expected one of {%s})", match[1], strings.Join(namingPlaceholders, "}, {"))
+			}
+			used[match[1]] = true
+		}
+		if strings.ContainsAny(namingPlaceholder.ReplaceAllString(template, ""), "{}") {
+			addf("naming template %q has an unmatched brace", template)
+		}
+		for _, required := range []string{"database", "timestamp", "ext"} {
+			if !used[required] {
+				addf("naming template must contain {%s}", required)
+			}
+		}
+		if servers > 1 && !used["server"] {
+			addf("naming template must contain {server} when several servers are configured")
+		}
+		if used["server"] && !serverSegment.MatchString(template) {
+			addf("naming template must use {server} as a whole folder name, as in {server}/")
+		}
+		if strings.HasPrefix(template, "/") {
+			addf("naming template must not start with /")
+		}
+	}
+	if strings.HasPrefix(naming.Prefix, "/") {
+		addf("naming prefix must not start with /")
+	}
+	switch naming.TimeZone {
+	case "", TimeZoneLocal, TimeZoneUTC:
+	default:
+		addf("invalid naming timezone %q (expected local or utc)", naming.TimeZone)
+	}
+	return problems
+}
+
+func validateMode(label, mode string, fullDump bool) []string {
+	switch mode {
+	case ModeLogical:
+		return nil
+	case ModePhysical:
+		if fullDump {
+			return []string{label + "full_dump cannot be combined with physical mode"}
+		}
+		return nil
+	default:
+		return []string{fmt.Sprintf("%sinvalid mode %q (expected logical or physical)", label, mode)}
+	}
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
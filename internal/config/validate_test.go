@@ -0,0 +1,171 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validYAML is a complete configuration that Load accepts.
+const validYAML = `
+database:
+  host: localhost
+  user: postgres
+storage:
+  type: local
+  local:
+    path: /var/backups/postgres
+schedule: "0 2 * * *"
+log_file: /var/log/pg-backup.log
+`
+
+// load writes data to a temporary file and loads it.
+func load(t *testing.T, data string) (*Config, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(file)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// want lists a part of every problem expected, in order; none
+		// means the configuration is valid.
+		want []string
+	}{
+		{"valid", validYAML, nil},
+		{"missing schedule and log file", `
+database: {host: localhost, user: postgres}
+storage: {type: local, local: {path: /backups}}
+`, []string{"schedule is required", "log file is required"}},
+		{"unknown key", validYAML + "shedule: \"0 3 * * *\"\n", []string{"field shedule not found"}},
+		{"invalid schedule", strings.Replace(validYAML, `"0 2 * * *"`, `"every night"`, 1), []string{`invalid schedule "every night"`}},
+		{"retention days and policy", validYAML + "retention_days: 7\nretention: {keep_daily: 7}\n", []string{"retention_days and retention cannot be used together"}},
+		{"retention below -1", validYAML + "retention: {keep_weekly: -2}\n", []string{"retention keep_weekly must be -1 (keep all)"}},
+		{"retention days keep all", validYAML + "retention_days: -1\n", nil},
+		{"retention days below -1", validYAML + "retention_days: -2\n", []string{"retention_days must be -1 (keep all)"}},
+		{"wal segment size", strings.Replace(validYAML, "user: postgres", "user: postgres\n  wal_segment_size: 24MB", 1), []string{"wal_segment_size must be a power of two"}},
+		{"naming template", validYAML + "naming: {template: \"{database}.{ext}\", timezone: mars}\n", []string{
+			"naming template must contain {timestamp}",
+			`invalid naming timezone "mars"`,
+		}},
+		{"servers", `
+servers:
+  - {name: main, host: db1, user: postgres}
+  - {name: main, host: db2, user: postgres, mode: archive}
+  - {name: "a/b", host: db3, user: postgres}
+storage: {type: local, local: {path: /backups}}
+schedule: "0 2 * * *"
+log_file: /var/log/pg-backup.log
+naming: {template: "{database}_{timestamp}.{ext}"}
+`, []string{
+			`servers[1] name "main" is used more than once`,
+			`servers[1] invalid mode "archive"`,
+			`servers[2] name "a/b" must not contain path separators`,
+			"naming template must contain {server} when several servers are configured",
+		}},
+		{"destinations", `
+database: {host: localhost, user: postgres}
+destinations:
+  - {name: fast, type: local, local: {path: /backups}}
+  - {name: fast, type: s3, s3: {bucket: backups, endpoint: s3.amazonaws.com, object_lock: {mode: governance}}}
+schedule: "0 2 * * *"
+log_file: /var/log/pg-backup.log
+destination_policy: some
+`, []string{
+			`destinations[1] name "fast" is used more than once`,
+			`invalid destination_policy "some"`,
+			"destinations[1] s3 object_lock needs retain_days",
+		}},
+		{"missing secret files", `
+servers:
+  - {name: main, host: db1, user: postgres, password_file: /nonexistent/main}
+  - {name: replica, host: db2, user: postgres, password_file: /nonexistent/replica}
+storage: {type: local, local: {path: /backups}}
+schedule: "0 2 * * *"
+log_file: /var/log/pg-backup.log
+`, []string{
+			"failed to read servers[0] password_file",
+			"failed to read servers[1] password_file",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(t, tt.yaml)
+			var problems []string
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				problems = validationErr.Problems
+			} else if err != nil {
+				t.Fatalf("Load returned %v, want a validation error", err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("problems %q, want %d matching %q", problems, len(tt.want), tt.want)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("problem %d is %q, want it to contain %q", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want []string
+	}{
+		{"unchanged", validYAML, validYAML, nil},
+		{
+			"changed, set and removed",
+			validYAML + "retention_days: 7\n",
+			strings.Replace(validYAML, `"0 2 * * *"`, `"0 3 * * *"`, 1) + "run_on_start: true\n",
+			[]string{
+				"retention_days: removed (was 7)",
+				"run_on_start: set to true",
+				"schedule: 0 2 * * * -> 0 3 * * *",
+			},
+		},
+		{
+			"secrets are not printed",
+			strings.Replace(validYAML, "user: postgres", "user: postgres\n  password: old-secret", 1),
+			strings.Replace(validYAML, "user: postgres", "user: postgres\n  password: new-secret", 1),
+			[]string{"database.password: changed"},
+		},
+		{
+			"lists",
+			validYAML + "retention: {keep_daily: 7}\n",
+			validYAML + "retention: {keep_daily: 14, keep_yearly: -1}\n",
+			[]string{
+				"retention.keep_daily: 7 -> 14",
+				"retention.keep_yearly: set to -1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, err := load(t, tt.old)
+			if err != nil {
+				t.Fatal(err)
+			}
+			new, err := load(t, tt.new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Diff(old, new); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Diff = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,27 +2,69 @@ package health
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	"pg-backup/internal/catalog"
 	"pg-backup/internal/logger"
 )
 
 type BackupService interface {
 	BackupAll() (int, error)
+	Catalog(filter catalog.Filter) ([]catalog.Entry, error)
 }
 
 type Status struct {
-	Status        string `json:"status"`
-	LastBackup    string `json:"last_backup"`
-	NextBackup    string `json:"next_backup"`
-	Uptime        string `json:"uptime"`
-	BackupCount   int    `json:"backup_count"`
-	DatabaseCount int    `json:"database_count"`
+	Status        string                       `json:"status"`
+	LastBackup    string                       `json:"last_backup"`
+	NextBackup    string                       `json:"next_backup"`
+	Uptime        string                       `json:"uptime"`
+	BackupCount   int                          `json:"backup_count"`
+	DatabaseCount int                          `json:"database_count"`
+	Servers       map[string]ServerStatus      `json:"servers,omitempty"`
+	Destinations  map[string]DestinationStatus `json:"destinations,omitempty"`
+}
+
+// ServerStatus is the outcome of the most recent backups of one server.
+type ServerStatus struct {
+	LastBackup     string  `json:"last_backup"`
+	LastSuccess    string  `json:"last_success,omitempty"`
+	LastError      string  `json:"last_error,omitempty"`
+	LastDuration   float64 `json:"last_duration_seconds"`
+	DatabaseCount  int     `json:"database_count"`
+	SuccessCount   int     `json:"success_count"`
+	FailureCount   int     `json:"failure_count"`
+	lastBackupTime time.Time
+	lastSuccessAt  time.Time
+	// Verifications holds the last restore verification of each database.
+	Verifications map[string]VerificationStatus `json:"verifications,omitempty"`
+}
+
+// VerificationStatus is the outcome of the last restore verification of one
+// database.
+type VerificationStatus struct {
+	LastVerification string `json:"last_verification"`
+	Success          bool   `json:"success"`
+	Error            string `json:"error,omitempty"`
+	verifiedAt       time.Time
+}
+
+// DestinationStatus is the outcome of the writes to one storage
+// destination.
+type DestinationStatus struct {
+	LastWrite     string `json:"last_write"`
+	LastSuccess   string `json:"last_success,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+	SuccessCount  int    `json:"success_count"`
+	FailureCount  int    `json:"failure_count"`
+	lastSuccessAt time.Time
 }
 
 type Service struct {
+	mu            sync.Mutex
 	logger        *logger.Logger
 	startTime     time.Time
 	lastBackup    time.Time
@@ -30,6 +72,8 @@ type Service struct {
 	backupCount   int
 	databaseCount int
 	backupService BackupService
+	servers       map[string]*ServerStatus
+	destinations  map[string]*DestinationStatus
 }
 
 func NewService(logger *logger.Logger, databaseCount int) *Service {
@@ -37,6 +81,8 @@ func NewService(logger *logger.Logger, databaseCount int) *Service {
 		logger:        logger,
 		startTime:     time.Now(),
 		databaseCount: databaseCount,
+		servers:       make(map[string]*ServerStatus),
+		destinations:  make(map[string]*DestinationStatus),
 	}
 }
 
@@ -45,16 +91,107 @@ func (s *Service) SetBackupService(backupService BackupService) {
 }
 
 func (s *Service) UpdateBackupStats(lastBackup, nextBackup time.Time, count, databaseCount int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.lastBackup = lastBackup
 	s.nextBackup = nextBackup
 	s.backupCount = count
 	s.databaseCount = databaseCount
 }
 
+func (s *Service) SetDatabaseCount(databaseCount int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.databaseCount = databaseCount
+}
+
+// ServerBackupFinished records the outcome of a backup of one server.
+func (s *Service) ServerBackupFinished(server string, started time.Time, databases int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.serverStatus(server)
+
+	now := time.Now()
+	status.lastBackupTime = now
+	status.LastBackup = now.Format("2006-01-02 15:04:05")
+	status.LastDuration = now.Sub(started).Seconds()
+	if err != nil {
+		status.LastError = err.Error()
+		status.FailureCount++
+		return
+	}
+	status.LastError = ""
+	status.lastSuccessAt = now
+	status.LastSuccess = status.LastBackup
+	status.DatabaseCount = databases
+	status.SuccessCount++
+}
+
+// VerificationFinished records the outcome of a restore verification of one
+// database.
+func (s *Service) VerificationFinished(server, database string, finished time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := s.serverStatus(server)
+	if status.Verifications == nil {
+		status.Verifications = make(map[string]VerificationStatus)
+	}
+
+	verification := VerificationStatus{
+		LastVerification: finished.Format("2006-01-02 15:04:05"),
+		Success:          err == nil,
+		verifiedAt:       finished,
+	}
+	if err != nil {
+		verification.Error = err.Error()
+	}
+	status.Verifications[database] = verification
+}
+
+// DestinationStored records the outcome of writing one object to a storage
+// destination.
+func (s *Service) DestinationStored(destination, filename string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.destinations[destination]
+	if !ok {
+		status = &DestinationStatus{}
+		s.destinations[destination] = status
+	}
+
+	now := time.Now()
+	status.LastWrite = now.Format("2006-01-02 15:04:05")
+	if err != nil {
+		status.LastError = fmt.Sprintf("%s: %v", filename, err)
+		status.FailureCount++
+		return
+	}
+	status.LastError = ""
+	status.lastSuccessAt = now
+	status.LastSuccess = status.LastWrite
+	status.SuccessCount++
+}
+
+// serverStatus returns the status of server, creating it if needed. The
+// caller must hold s.mu.
+func (s *Service) serverStatus(server string) *ServerStatus {
+	status, ok := s.servers[server]
+	if !ok {
+		status = &ServerStatus{}
+		s.servers[server] = status
+	}
+	return status
+}
+
 func (s *Service) Start(port int) {
 	http.HandleFunc("/health", s.healthHandler)
 	http.HandleFunc("/status", s.statusHandler)
 	http.HandleFunc("/trigger", s.triggerHandler)
+	http.HandleFunc("/metrics", s.metricsHandler)
+	http.HandleFunc("/backups", s.backupsHandler)
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
@@ -75,6 +212,9 @@ func (s *Service) healthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Service) statusHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	status := Status{
 		Status:        "running",
 		Uptime:        time.Since(s.startTime).String(),
@@ -94,6 +234,27 @@ func (s *Service) statusHandler(w http.ResponseWriter, r *http.Request) {
 		status.NextBackup = "not scheduled"
 	}
 
+	if len(s.servers) > 0 {
+		status.Servers = make(map[string]ServerStatus, len(s.servers))
+		for name, server := range s.servers {
+			copied := *server
+			if server.Verifications != nil {
+				copied.Verifications = make(map[string]VerificationStatus, len(server.Verifications))
+				for database, verification := range server.Verifications {
+					copied.Verifications[database] = verification
+				}
+			}
+			status.Servers[name] = copied
+		}
+	}
+
+	if len(s.destinations) > 0 {
+		status.Destinations = make(map[string]DestinationStatus, len(s.destinations))
+		for name, destination := range s.destinations {
+			status.Destinations[name] = *destination
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(status)
@@ -129,7 +290,10 @@ func (s *Service) triggerHandler(w http.ResponseWriter, r *http.Request) {
 			s.logger.Error("Manual backup failed: %v", err)
 		} else {
 			s.logger.Info("Manual backup completed successfully for %d databases", dbCount)
-			s.UpdateBackupStats(time.Now(), time.Time{}, s.backupCount+1, dbCount)
+			s.mu.Lock()
+			count := s.backupCount + 1
+			s.mu.Unlock()
+			s.UpdateBackupStats(time.Now(), time.Time{}, count, dbCount)
 		}
 	}()
 
@@ -141,3 +305,72 @@ func (s *Service) triggerHandler(w http.ResponseWriter, r *http.Request) {
 		"started_at": start.Format("2006-01-02 15:04:05"),
 	})
 }
+
+// backupsHandler lists the stored backups. The server, database, since and
+// until query parameters filter the list like the list-backups command.
+func (s *Service) backupsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Only GET method is allowed",
+		})
+		return
+	}
+
+	if s.backupService == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Backup service not available",
+		})
+		return
+	}
+
+	query := r.URL.Query()
+	filter := catalog.Filter{
+		Server:   query.Get("server"),
+		Database: query.Get("database"),
+	}
+	for _, bound := range []struct {
+		name   string
+		target *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	} {
+		value := query.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		t, err := catalog.ParseTime(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": fmt.Sprintf("invalid %s: %v", bound.name, err),
+			})
+			return
+		}
+		*bound.target = t
+	}
+
+	entries, err := s.backupService.Catalog(filter)
+	if errors.Is(err, catalog.ErrUnknownServer) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		s.logger.Error("Failed to list backups: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
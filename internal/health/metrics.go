@@ -0,0 +1,127 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// metricsHandler exposes the backup status in the Prometheus text format.
+func (s *Service) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP pgbackup_uptime_seconds Time since the process started.")
+	fmt.Fprintln(w, "# TYPE pgbackup_uptime_seconds gauge")
+	fmt.Fprintf(w, "pgbackup_uptime_seconds %g\n", time.Since(s.startTime).Seconds())
+
+	names := make([]string, 0, len(s.servers))
+	for name := range s.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name  string
+		help  string
+		kind  string
+		value func(*ServerStatus) float64
+	}{
+		{"pgbackup_last_backup_timestamp_seconds", "Unix time of the last backup attempt.", "gauge",
+			func(st *ServerStatus) float64 { return unixSeconds(st.lastBackupTime) }},
+		{"pgbackup_last_success_timestamp_seconds", "Unix time of the last successful backup.", "gauge",
+			func(st *ServerStatus) float64 { return unixSeconds(st.lastSuccessAt) }},
+		{"pgbackup_last_backup_success", "Whether the last backup attempt succeeded.", "gauge",
+			func(st *ServerStatus) float64 { return boolValue(st.LastError == "") }},
+		{"pgbackup_last_backup_duration_seconds", "Duration of the last backup attempt.", "gauge",
+			func(st *ServerStatus) float64 { return st.LastDuration }},
+		{"pgbackup_databases", "Databases backed up by the last successful backup.", "gauge",
+			func(st *ServerStatus) float64 { return float64(st.DatabaseCount) }},
+		{"pgbackup_backups_succeeded_total", "Successful backups since the process started.", "counter",
+			func(st *ServerStatus) float64 { return float64(st.SuccessCount) }},
+		{"pgbackup_backups_failed_total", "Failed backups since the process started.", "counter",
+			func(st *ServerStatus) float64 { return float64(st.FailureCount) }},
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{server=%q} %g\n", metric.name, name, metric.value(s.servers[name]))
+		}
+	}
+
+	destinations := make([]string, 0, len(s.destinations))
+	for name := range s.destinations {
+		destinations = append(destinations, name)
+	}
+	sort.Strings(destinations)
+
+	destinationMetrics := []struct {
+		name  string
+		help  string
+		kind  string
+		value func(*DestinationStatus) float64
+	}{
+		{"pgbackup_destination_last_success_timestamp_seconds", "Unix time of the last successful write to the destination.", "gauge",
+			func(d *DestinationStatus) float64 { return unixSeconds(d.lastSuccessAt) }},
+		{"pgbackup_destination_last_write_success", "Whether the last write to the destination succeeded.", "gauge",
+			func(d *DestinationStatus) float64 { return boolValue(d.LastError == "") }},
+		{"pgbackup_destination_writes_succeeded_total", "Successful writes to the destination since the process started.", "counter",
+			func(d *DestinationStatus) float64 { return float64(d.SuccessCount) }},
+		{"pgbackup_destination_writes_failed_total", "Failed writes to the destination since the process started.", "counter",
+			func(d *DestinationStatus) float64 { return float64(d.FailureCount) }},
+	}
+
+	for _, metric := range destinationMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		for _, name := range destinations {
+			fmt.Fprintf(w, "%s{destination=%q} %g\n", metric.name, name, metric.value(s.destinations[name]))
+		}
+	}
+
+	verificationMetrics := []struct {
+		name  string
+		help  string
+		value func(VerificationStatus) float64
+	}{
+		{"pgbackup_last_verification_timestamp_seconds", "Unix time of the last restore verification.",
+			func(v VerificationStatus) float64 { return unixSeconds(v.verifiedAt) }},
+		{"pgbackup_last_verification_success", "Whether the last restore verification succeeded.",
+			func(v VerificationStatus) float64 { return boolValue(v.Success) }},
+	}
+
+	for _, metric := range verificationMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", metric.name)
+		for _, name := range names {
+			verifications := s.servers[name].Verifications
+			databases := make([]string, 0, len(verifications))
+			for database := range verifications {
+				databases = append(databases, database)
+			}
+			sort.Strings(databases)
+			for _, database := range databases {
+				fmt.Fprintf(w, "%s{server=%q,database=%q} %g\n", metric.name, name, database, metric.value(verifications[database]))
+			}
+		}
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
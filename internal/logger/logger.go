@@ -26,6 +26,12 @@ func New(filename string) *Logger {
 	}
 }
 
+// NewStderr returns a logger writing to standard error, for commands that
+// must not create or append to the log file.
+func NewStderr() *Logger {
+	return &Logger{logger: log.New(os.Stderr, "", 0)}
+}
+
 func (l *Logger) Info(format string, args ...interface{}) {
 	l.log("INFO", format, args...)
 }
@@ -45,5 +51,8 @@ func (l *Logger) log(level, format string, args ...interface{}) {
 }
 
 func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
 	return l.file.Close()
 }
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// azureVersion is the Blob service REST API version requests are made
+// with; it is the first to support the Cold access tier.
+const azureVersion = "2021-12-02"
+
+// azureBlockSize is the size of the blocks large backups are uploaded in.
+// A block blob holds at most 50,000 blocks, so this allows about 800 GB.
+const azureBlockSize = 16 << 20
+
+// AzureOptions configures an Azure Blob Storage provider.
+type AzureOptions struct {
+	Account string
+	// AccountKey signs requests with Shared Key authorization; SASToken is
+	// appended to every request instead when it is set.
+	AccountKey string
+	SASToken   string
+	Container  string
+	// Prefix is prepended to every blob name.
+	Prefix string
+	// Endpoint overrides https://<account>.blob.core.windows.net, e.g. for
+	// the Azurite emulator (http://127.0.0.1:10000/devstoreaccount1).
+	Endpoint string
+	// AccessTier is set on uploaded blobs: Hot, Cool, Cold or Archive.
+	AccessTier string
+}
+
+// Azure stores backups as block blobs using the Blob service REST API.
+type Azure struct {
+	client     *http.Client
+	baseURL    *url.URL
+	account    string
+	key        []byte
+	sasQuery   url.Values
+	container  string
+	prefix     string
+	accessTier string
+}
+
+func NewAzure(options AzureOptions) (*Azure, error) {
+	endpoint := options.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", options.Account)
+	}
+	baseURL, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	a := &Azure{
+		client:     &http.Client{},
+		baseURL:    baseURL,
+		account:    options.Account,
+		container:  options.Container,
+		prefix:     options.Prefix,
+		accessTier: options.AccessTier,
+	}
+	switch {
+	case options.SASToken != "":
+		if a.sasQuery, err = url.ParseQuery(strings.TrimPrefix(options.SASToken, "?")); err != nil {
+			return nil, fmt.Errorf("invalid SAS token: %w", err)
+		}
+	case options.AccountKey != "":
+		if a.key, err = base64.StdEncoding.DecodeString(options.AccountKey); err != nil {
+			return nil, fmt.Errorf("invalid account key: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("azure needs an account key or a SAS token")
+	}
+	return a, nil
+}
+
+// Store uploads data as a block blob. Data that fits in one block is sent
+// with a single Put Blob; larger backups are streamed block by block and
+// committed with Put Block List, so they never need to fit in memory.
+func (a *Azure) Store(filename string, data io.Reader) error {
+	blobName := a.prefix + filename
+	block := make([]byte, azureBlockSize)
+
+	n, err := io.ReadFull(data, block)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		headers := http.Header{"X-Ms-Blob-Type": {"BlockBlob"}}
+		a.setTier(headers)
+		_, err := a.do(http.MethodPut, blobName, nil, headers, block[:n])
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	var blockIDs []string
+	for {
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blockIDs))))
+		query := url.Values{"comp": {"block"}, "blockid": {id}}
+		if _, err := a.do(http.MethodPut, blobName, query, nil, block[:n]); err != nil {
+			return err
+		}
+		blockIDs = append(blockIDs, id)
+
+		n, err = io.ReadFull(data, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blockIDs {
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+
+	headers := http.Header{"Content-Type": {"application/xml"}}
+	a.setTier(headers)
+	_, err = a.do(http.MethodPut, blobName, url.Values{"comp": {"blocklist"}}, headers, blockList.Bytes())
+	return err
+}
+
+func (a *Azure) setTier(headers http.Header) {
+	if a.accessTier != "" {
+		headers.Set("X-Ms-Access-Tier", a.accessTier)
+	}
+}
+
+func (a *Azure) Open(filename string) (io.ReadCloser, error) {
+	resp, err := a.send(http.MethodGet, a.prefix+filename, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type azureBlobList struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+func (a *Azure) List(prefix string) ([]Object, error) {
+	var objects []Object
+	marker := ""
+	for {
+		query := url.Values{
+			"restype": {"container"},
+			"comp":    {"list"},
+			"prefix":  {a.prefix + prefix},
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		body, err := a.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var list azureBlobList
+		if err := xml.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse blob list: %w", err)
+		}
+
+		for _, blob := range list.Blobs {
+			modTime, _ := time.Parse(http.TimeFormat, blob.Properties.LastModified)
+			objects = append(objects, Object{
+				Name:    strings.TrimPrefix(blob.Name, a.prefix),
+				Size:    blob.Properties.ContentLength,
+				ModTime: modTime,
+			})
+		}
+
+		if list.NextMarker == "" {
+			return objects, nil
+		}
+		marker = list.NextMarker
+	}
+}
+
+func (a *Azure) Delete(filename string) error {
+	_, err := a.do(http.MethodDelete, a.prefix+filename, nil, nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// do sends a request and returns the response body.
+func (a *Azure) do(method, blobName string, query url.Values, headers http.Header, body []byte) ([]byte, error) {
+	resp, err := a.send(method, blobName, query, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// send signs and sends a request for blobName, or for the container when
+// blobName is empty. A 404 is returned as ErrNotFound and any other error
+// status as an error carrying the service's error code; on success the
+// caller must close the response body.
+func (a *Azure) send(method, blobName string, query url.Values, headers http.Header, body []byte) (*http.Response, error) {
+	u := *a.baseURL
+	u.Path += "/" + a.container
+	if blobName != "" {
+		u.Path += "/" + blobName
+	}
+
+	params := url.Values{}
+	for name, values := range query {
+		params[name] = values
+	}
+	for name, values := range a.sasQuery {
+		params[name] = values
+	}
+	u.RawQuery = params.Encode()
+
+	var reader io.Reader = http.NoBody
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("X-Ms-Version", azureVersion)
+	if a.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+a.account+":"+a.sign(req, query))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && blobName != "" {
+		return nil, ErrNotFound
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var azureError struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(message, &azureError) == nil && azureError.Code != "" {
+		return nil, fmt.Errorf("azure %s %s: %s: %s", method, u.Path, resp.Status, azureError.Code)
+	}
+	if code := resp.Header.Get("X-Ms-Error-Code"); code != "" {
+		return nil, fmt.Errorf("azure %s %s: %s: %s", method, u.Path, resp.Status, code)
+	}
+	return nil, fmt.Errorf("azure %s %s: %s", method, u.Path, resp.Status)
+}
+
+// sign computes the Shared Key signature of a request.
+func (a *Azure) sign(req *http.Request, query url.Values) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var headerNames []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			headerNames = append(headerNames, lower)
+		}
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+
+	canonicalResource := "/" + a.account + req.URL.EscapedPath()
+	var queryNames []string
+	for name := range query {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	for _, name := range queryNames {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		canonicalResource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date; x-ms-date is used instead
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + canonicalHeaders.String() + canonicalResource
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The well-known Azurite development account.
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// TestAzureSign checks Shared Key signatures against values computed
+// independently from the Blob service documentation.
+func TestAzureSign(t *testing.T) {
+	a, err := NewAzure(AzureOptions{
+		Account:    azuriteAccount,
+		AccountKey: azuriteKey,
+		Container:  "backups",
+		Endpoint:   "http://127.0.0.1:10000/" + azuriteAccount,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		query  url.Values
+		header http.Header
+		body   string
+		want   string
+	}{
+		{
+			name:   "put blob",
+			method: http.MethodPut,
+			url:    "http://127.0.0.1:10000/devstoreaccount1/backups/main/app.sql.gz",
+			header: http.Header{"X-Ms-Blob-Type": {"BlockBlob"}},
+			body:   "dump",
+			want:   "b8B97aveb82HnUSTOAm67VcUIzPkbzyXTz/JfaI6TsI=",
+		},
+		{
+			name:   "list blobs",
+			method: http.MethodGet,
+			url:    "http://127.0.0.1:10000/devstoreaccount1/backups?comp=list&prefix=main%2F&restype=container",
+			query:  url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {"main/"}},
+			want:   "KKF9nc83Bo6IoOZ17vVBEGOi9d4CsfnpjS6IoLkhslI=",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = http.NoBody
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, tt.url, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, values := range tt.header {
+				req.Header[name] = values
+			}
+			req.Header.Set("X-Ms-Date", "Mon, 01 Jan 2024 00:00:00 GMT")
+			req.Header.Set("X-Ms-Version", azureVersion)
+
+			if got := a.sign(req, tt.query); got != tt.want {
+				t.Errorf("sign() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeAzure is a minimal Blob service holding one account's blobs in
+// memory. It checks every request's Shared Key signature, or its SAS
+// token when sasToken is set.
+type fakeAzure struct {
+	t        *testing.T
+	key      []byte
+	sasToken url.Values
+	pageSize int
+
+	mu     sync.Mutex
+	blobs  map[string][]byte
+	tiers  map[string]string
+	blocks map[string][]byte
+	puts   int
+}
+
+func newFakeAzure(t *testing.T) *fakeAzure {
+	key, _ := base64.StdEncoding.DecodeString(azuriteKey)
+	return &fakeAzure{
+		t:        t,
+		key:      key,
+		pageSize: 2,
+		blobs:    make(map[string][]byte),
+		tiers:    make(map[string]string),
+		blocks:   make(map[string][]byte),
+	}
+}
+
+func (f *fakeAzure) start(t *testing.T, options AzureOptions) *Azure {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	options.Account = azuriteAccount
+	options.Container = "backups"
+	options.Endpoint = server.URL + "/" + azuriteAccount
+	a, err := NewAzure(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (f *fakeAzure) fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("X-Ms-Error-Code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// signature computes a request's Shared Key signature as the service
+// does.
+func (f *fakeAzure) signature(r *http.Request) string {
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = strconv.FormatInt(r.ContentLength, 10)
+	}
+	var headers []string
+	for name, values := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			headers = append(headers, lower+":"+values[0]+"\n")
+		}
+	}
+	sort.Strings(headers)
+
+	resource := "/" + azuriteAccount + r.URL.EscapedPath()
+	query := r.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		resource += "\n" + name + ":" + strings.Join(query[name], ",")
+	}
+
+	fields := []string{r.Method, "", "", contentLength, "", r.Header.Get("Content-Type"), "", "", "", "", "", ""}
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(strings.Join(fields, "\n") + "\n" + strings.Join(headers, "") + resource))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Ms-Version") != azureVersion || r.Header.Get("X-Ms-Date") == "" {
+		f.fail(w, http.StatusBadRequest, "MissingRequiredHeader")
+		return
+	}
+	if f.sasToken != nil {
+		if r.URL.Query().Get("sig") != f.sasToken.Get("sig") || r.Header.Get("Authorization") != "" {
+			f.fail(w, http.StatusForbidden, "AuthenticationFailed")
+			return
+		}
+	} else if r.Header.Get("Authorization") != "SharedKey "+azuriteAccount+":"+f.signature(r) {
+		f.fail(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+azuriteAccount+"/backups")
+	name := strings.TrimPrefix(path, "/")
+	query := r.URL.Query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && name == "" && query.Get("comp") == "list":
+		f.list(w, query)
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		body, _ := io.ReadAll(r.Body)
+		f.blocks[name+"/"+query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var list struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&list); err != nil {
+			f.fail(w, http.StatusBadRequest, "InvalidXmlDocument")
+			return
+		}
+		var blob []byte
+		for _, id := range list.Latest {
+			block, ok := f.blocks[name+"/"+id]
+			if !ok {
+				f.fail(w, http.StatusBadRequest, "InvalidBlockList")
+				return
+			}
+			blob = append(blob, block...)
+		}
+		f.blobs[name] = blob
+		f.tiers[name] = r.Header.Get("X-Ms-Access-Tier")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("X-Ms-Blob-Type") != "BlockBlob" {
+			f.fail(w, http.StatusBadRequest, "InvalidHeaderValue")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.blobs[name] = body
+		f.tiers[name] = r.Header.Get("X-Ms-Access-Tier")
+		f.puts++
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet:
+		blob, ok := f.blobs[name]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		w.Write(blob)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.blobs[name]; !ok {
+			f.fail(w, http.StatusNotFound, "BlobNotFound")
+			return
+		}
+		delete(f.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		f.fail(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (f *fakeAzure) list(w http.ResponseWriter, query url.Values) {
+	var names []string
+	for name := range f.blobs {
+		if strings.HasPrefix(name, query.Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(query.Get("marker"))
+	end := start + f.pageSize
+	next := strconv.Itoa(end)
+	if end >= len(names) {
+		end = len(names)
+		next = ""
+	}
+
+	var response bytes.Buffer
+	response.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for _, name := range names[start:end] {
+		fmt.Fprintf(&response, `<Blob><Name>%s</Name><Properties><Last-Modified>Mon, 01 Jan 2024 00:00:00 GMT</Last-Modified><Content-Length>%d</Content-Length></Properties></Blob>`, name, len(f.blobs[name]))
+	}
+	fmt.Fprintf(&response, `</Blobs><NextMarker>%s</NextMarker></EnumerationResults>`, next)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(response.Bytes())
+}
+
+func TestAzureStoreOpenListDelete(t *testing.T) {
+	fake := newFakeAzure(t)
+	a := fake.start(t, AzureOptions{AccountKey: azuriteKey, Prefix: "pg/", AccessTier: "Cool"})
+
+	for _, name := range []string{"main/app.sql.gz", "main/crm.sql.gz", "main/wal/0001.gz", "other/app.sql.gz"} {
+		if err := a.Store(name, strings.NewReader("dump of "+name)); err != nil {
+			t.Fatalf("Store(%s): %v", name, err)
+		}
+	}
+	if fake.tiers["pg/main/app.sql.gz"] != "Cool" {
+		t.Errorf("access tier = %q, want Cool", fake.tiers["pg/main/app.sql.gz"])
+	}
+
+	if got := readObject(t, a, "main/app.sql.gz"); got != "dump of main/app.sql.gz" {
+		t.Errorf("Open returned %q", got)
+	}
+	if _, err := a.Open("main/missing.sql.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of a missing blob returned %v, want ErrNotFound", err)
+	}
+
+	// Three blobs with a page size of two need a continuation marker.
+	objects, err := a.List("main/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if want := "main/app.sql.gz,main/crm.sql.gz,main/wal/0001.gz"; strings.Join(names, ",") != want {
+		t.Errorf("List returned %v, want %s", names, want)
+	}
+	if objects[0].Size != int64(len("dump of main/app.sql.gz")) || objects[0].ModTime.IsZero() {
+		t.Errorf("List returned size %d and time %v", objects[0].Size, objects[0].ModTime)
+	}
+
+	if err := a.Delete("main/app.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := a.Delete("main/app.sql.gz"); err != nil {
+		t.Errorf("Delete of a missing blob: %v", err)
+	}
+	if _, ok := fake.blobs["pg/main/app.sql.gz"]; ok {
+		t.Error("blob still exists after Delete")
+	}
+}
+
+func TestAzureStoreEmptyBlob(t *testing.T) {
+	fake := newFakeAzure(t)
+	a := fake.start(t, AzureOptions{AccountKey: azuriteKey})
+
+	if err := a.Store("empty.sql.gz", bytes.NewReader(nil)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if blob, ok := fake.blobs["empty.sql.gz"]; !ok || len(blob) != 0 {
+		t.Errorf("stored %d bytes (present: %v), want an empty blob", len(blob), ok)
+	}
+}
+
+func TestAzureStoreBlocks(t *testing.T) {
+	fake := newFakeAzure(t)
+	a := fake.start(t, AzureOptions{AccountKey: azuriteKey, AccessTier: "Archive"})
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*azureBlockSize+1000)/16)
+	if err := a.Store("basebackup.tar.gz", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if !bytes.Equal(fake.blobs["basebackup.tar.gz"], data) {
+		t.Errorf("committed blob holds %d bytes, want %d", len(fake.blobs["basebackup.tar.gz"]), len(data))
+	}
+	if len(fake.blocks) != 3 || fake.puts != 0 {
+		t.Errorf("uploaded %d blocks and %d single blobs, want 3 blocks", len(fake.blocks), fake.puts)
+	}
+	if fake.tiers["basebackup.tar.gz"] != "Archive" {
+		t.Errorf("access tier = %q, want Archive", fake.tiers["basebackup.tar.gz"])
+	}
+}
+
+func TestAzureSASToken(t *testing.T) {
+	fake := newFakeAzure(t)
+	fake.sasToken = url.Values{"sv": {"2021-12-02"}, "sig": {"c2lnbmF0dXJl"}}
+	a := fake.start(t, AzureOptions{SASToken: "?" + fake.sasToken.Encode()})
+
+	if err := a.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store with a SAS token: %v", err)
+	}
+	if got := readObject(t, a, "app.sql.gz"); got != "dump" {
+		t.Errorf("Open returned %q", got)
+	}
+}
+
+func TestAzureErrors(t *testing.T) {
+	fake := newFakeAzure(t)
+	a := fake.start(t, AzureOptions{AccountKey: base64.StdEncoding.EncodeToString([]byte("wrong key"))})
+
+	err := a.Store("app.sql.gz", strings.NewReader("dump"))
+	if err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Errorf("Store with a wrong key returned %v, want AuthenticationFailed", err)
+	}
+
+	if _, err := NewAzure(AzureOptions{Account: azuriteAccount, Container: "backups"}); err == nil {
+		t.Error("NewAzure without credentials succeeded")
+	}
+	if _, err := NewAzure(AzureOptions{Account: azuriteAccount, Container: "backups", AccountKey: "not base64!"}); err == nil {
+		t.Error("NewAzure with an invalid key succeeded")
+	}
+}
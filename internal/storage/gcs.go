@@ -0,0 +1,431 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsChunkSize is the size of the chunks resumable uploads are sent in; it
+// must be a multiple of 256 KiB.
+const gcsChunkSize = 16 << 20
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// GCSOptions configures a Google Cloud Storage provider.
+type GCSOptions struct {
+	Bucket string
+	// Prefix is prepended to every object name.
+	Prefix string
+	// CredentialsFile is a service account key in JSON format. It defaults
+	// to $GOOGLE_APPLICATION_CREDENTIALS. One of them is required unless
+	// Endpoint is set, in which case requests may be sent unauthenticated
+	// to a fake server.
+	CredentialsFile string
+	// StorageClass is set on uploaded objects, e.g. NEARLINE; empty uses the
+	// bucket's default class.
+	StorageClass string
+	// Endpoint overrides https://storage.googleapis.com, e.g. for a fake
+	// GCS server.
+	Endpoint string
+}
+
+// GCS stores backups as objects using the Cloud Storage JSON API.
+type GCS struct {
+	client       *http.Client
+	endpoint     string
+	bucket       string
+	prefix       string
+	storageClass string
+	account      *serviceAccount
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// serviceAccount holds the fields of a service account key file that are
+// needed to obtain access tokens.
+type serviceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+func NewGCS(options GCSOptions) (*GCS, error) {
+	endpoint := options.Endpoint
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+
+	g := &GCS{
+		client: &http.Client{
+			// A 308 acknowledges an upload chunk; it is not a redirect.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		endpoint:     strings.TrimSuffix(endpoint, "/"),
+		bucket:       options.Bucket,
+		prefix:       options.Prefix,
+		storageClass: options.StorageClass,
+	}
+
+	credentialsFile := options.CredentialsFile
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if credentialsFile == "" {
+		if options.Endpoint == "" {
+			return nil, fmt.Errorf("gcs needs credentials_file or $GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		return g, nil
+	}
+	account, err := loadServiceAccount(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	g.account = account
+	return g, nil
+}
+
+func loadServiceAccount(path string) (*serviceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials: %w", err)
+	}
+	var account serviceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials %s: %w", path, err)
+	}
+	if account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, fmt.Errorf("credentials %s are not a service account key", path)
+	}
+	if account.TokenURI == "" {
+		account.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("credentials %s: private key is not PEM encoded", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("credentials %s: failed to parse private key: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("credentials %s: private key is not an RSA key", path)
+	}
+	account.key = rsaKey
+	return &account, nil
+}
+
+// accessToken returns a cached OAuth access token, exchanging a freshly
+// signed JWT for a new one shortly before the old one expires.
+func (g *GCS) accessToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.token != "" && time.Now().Before(g.tokenExpiry) {
+		return g.token, nil
+	}
+
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   g.account.ClientEmail,
+		"scope": gcsScope,
+		"aud":   g.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, g.account.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token request: %w", err)
+	}
+
+	resp, err := g.client.PostForm(g.account.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to request access token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("failed to request access token: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to decode access token: %w", err)
+	}
+	g.token = token.AccessToken
+	g.tokenExpiry = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return g.token, nil
+}
+
+func (g *GCS) objectURL(name string) string {
+	return g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o/" + url.PathEscape(name)
+}
+
+// Store streams data with a resumable upload: a session is started with the
+// object's metadata and the data is sent in chunks, so a backup never has to
+// fit in memory.
+func (g *GCS) Store(filename string, data io.Reader) error {
+	metadata := map[string]string{"name": g.prefix + filename}
+	if g.storageClass != "" {
+		metadata["storageClass"] = g.storageClass
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	uploadURL := g.endpoint + "/upload/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?uploadType=resumable"
+	headers := http.Header{"Content-Type": {"application/json; charset=UTF-8"}}
+	resp, err := g.send(http.MethodPost, uploadURL, headers, body)
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("gcs: bucket %s not found", g.bucket)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("gcs: upload of %s returned no session URL", filename)
+	}
+
+	// chunk holds the data from offset on that the service has not
+	// confirmed yet; a chunk it only took part of is sent again from where
+	// it stopped.
+	chunk := make([]byte, gcsChunkSize)
+	var offset int64
+	filled := 0
+	last := false
+	for {
+		if !last {
+			n, err := io.ReadFull(data, chunk[filled:])
+			filled += n
+			last = err == io.EOF || err == io.ErrUnexpectedEOF
+			if err != nil && !last {
+				g.cancelUpload(session)
+				return err
+			}
+		}
+
+		var contentRange string
+		switch {
+		case filled == 0:
+			contentRange = fmt.Sprintf("bytes */%d", offset)
+		case last:
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(filled)-1, offset+int64(filled))
+		default:
+			contentRange = fmt.Sprintf("bytes %d-%d/*", offset, offset+int64(filled)-1)
+		}
+
+		resp, err := g.send(http.MethodPut, session, http.Header{"Content-Range": {contentRange}}, chunk[:filled])
+		if err != nil {
+			g.cancelUpload(session)
+			return err
+		}
+		resp.Body.Close()
+		if last && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated) {
+			return nil
+		}
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			g.cancelUpload(session)
+			return fmt.Errorf("gcs: upload of %s finished early with %s", filename, resp.Status)
+		}
+		if last {
+			g.cancelUpload(session)
+			return fmt.Errorf("gcs: upload of %s was not completed after the last chunk", filename)
+		}
+
+		persisted, err := persistedBytes(resp.Header.Get("Range"))
+		if err != nil || persisted <= offset || persisted > offset+int64(filled) {
+			g.cancelUpload(session)
+			if err == nil {
+				err = fmt.Errorf("confirmed %d bytes after sending up to %d", persisted, offset+int64(filled))
+			}
+			return fmt.Errorf("gcs: upload of %s: %w", filename, err)
+		}
+		filled = copy(chunk, chunk[persisted-offset:filled])
+		offset = persisted
+	}
+}
+
+// persistedBytes parses the Range header of a resumable upload response,
+// "bytes=0-N", into the number of bytes the service has stored. No header
+// means nothing was stored.
+func persistedBytes(header string) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	end, ok := strings.CutPrefix(header, "bytes=0-")
+	if !ok {
+		return 0, fmt.Errorf("invalid Range %q", header)
+	}
+	n, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Range %q", header)
+	}
+	return n + 1, nil
+}
+
+// cancelUpload abandons a resumable upload session so no partial object is
+// left behind.
+func (g *GCS) cancelUpload(session string) {
+	resp, err := g.send(http.MethodDelete, session, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (g *GCS) Open(filename string) (io.ReadCloser, error) {
+	resp, err := g.send(http.MethodGet, g.objectURL(g.prefix+filename)+"?alt=media", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type gcsObjectList struct {
+	Items []struct {
+		Name    string    `json:"name"`
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (g *GCS) List(prefix string) ([]Object, error) {
+	var objects []Object
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {g.prefix + prefix}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		listURL := g.endpoint + "/storage/v1/b/" + url.PathEscape(g.bucket) + "/o?" + query.Encode()
+		resp, err := g.send(http.MethodGet, listURL, nil, nil)
+		if errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("gcs: bucket %s not found", g.bucket)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var list gcsObjectList
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse object list: %w", err)
+		}
+
+		for _, item := range list.Items {
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			objects = append(objects, Object{
+				Name:    strings.TrimPrefix(item.Name, g.prefix),
+				Size:    size,
+				ModTime: item.Updated,
+			})
+		}
+
+		if list.NextPageToken == "" {
+			return objects, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+func (g *GCS) Delete(filename string) error {
+	resp, err := g.send(http.MethodDelete, g.objectURL(g.prefix+filename), nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// send authorizes and sends a request. A 404 is returned as ErrNotFound and
+// any other error status as an error carrying the service's message; on
+// success the caller must close the response body.
+func (g *GCS) send(method, rawURL string, headers http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader = http.NoBody
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if g.account != nil {
+		token, err := g.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 || resp.StatusCode == http.StatusPermanentRedirect {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var gcsError struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(message, &gcsError) == nil && gcsError.Error.Message != "" {
+		return nil, fmt.Errorf("gcs %s %s: %s: %s", method, req.URL.Path, resp.Status, gcsError.Error.Message)
+	}
+	return nil, fmt.Errorf("gcs %s %s: %s", method, req.URL.Path, resp.Status)
+}
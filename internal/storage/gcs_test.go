@@ -0,0 +1,532 @@
+package storage
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const gcsTestAccount = "backup@project.iam.gserviceaccount.com"
+
+// fakeGCS is a minimal Cloud Storage JSON API with an OAuth token endpoint.
+// Token requests must carry a JWT signed with the test service account's
+// key, and every other request the token handed out.
+type fakeGCS struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu       sync.Mutex
+	tokens   int
+	objects  map[string][]byte
+	classes  map[string]string
+	sessions map[string]*gcsTestSession
+	// failChunk makes the upload of the chunk with this index fail.
+	failChunk int
+	// shortChunk makes the service keep only part of the chunk with this
+	// index, dropping its last shortBytes bytes.
+	shortChunk int
+	shortBytes int
+	// holdLast answers the last chunk with 308 instead of finalizing.
+	holdLast bool
+}
+
+type gcsTestSession struct {
+	name      string
+	class     string
+	data      []byte
+	ranges    []string
+	cancelled bool
+}
+
+func newFakeGCS(t *testing.T) *fakeGCS {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeGCS{
+		t:          t,
+		key:        key,
+		objects:    make(map[string][]byte),
+		classes:    make(map[string]string),
+		sessions:   make(map[string]*gcsTestSession),
+		failChunk:  -1,
+		shortChunk: -1,
+	}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// credentials writes a service account key file for the fake.
+func (f *fakeGCS) credentials(t *testing.T) string {
+	der, err := x509.MarshalPKCS8PrivateKey(f.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": gcsTestAccount,
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    f.server.URL + "/token",
+	})
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (f *fakeGCS) provider(t *testing.T, options GCSOptions) *GCS {
+	options.Bucket = "backups"
+	options.Endpoint = f.server.URL
+	options.CredentialsFile = f.credentials(t)
+	g, err := NewGCS(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func (f *fakeGCS) fail(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": status, "message": message}})
+}
+
+// checkAssertion verifies a JWT bearer assertion.
+func (f *fakeGCS) checkAssertion(assertion string) error {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&f.key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return err
+	}
+
+	var claims struct {
+		Iss   string `json:"iss"`
+		Scope string `json:"scope"`
+		Aud   string `json:"aud"`
+		Iat   int64  `json:"iat"`
+		Exp   int64  `json:"exp"`
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return err
+	}
+	if claims.Iss != gcsTestAccount || claims.Scope != gcsScope || claims.Aud != f.server.URL+"/token" {
+		return fmt.Errorf("unexpected claims %+v", claims)
+	}
+	if claims.Exp-claims.Iat != 3600 {
+		return fmt.Errorf("token lifetime %ds", claims.Exp-claims.Iat)
+	}
+	return nil
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			f.fail(w, http.StatusBadRequest, "unsupported grant type")
+			return
+		}
+		if err := f.checkAssertion(r.FormValue("assertion")); err != nil {
+			f.fail(w, http.StatusBadRequest, "invalid assertion: "+err.Error())
+			return
+		}
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", f.tokens),
+			"expires_in":   3600,
+			"token_type":   "Bearer",
+		})
+		return
+	}
+	if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", f.tokens) || f.tokens == 0 {
+		f.fail(w, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == http.MethodPost && path == "/upload/storage/v1/b/backups/o" && r.URL.Query().Get("uploadType") == "resumable":
+		var metadata struct {
+			Name         string `json:"name"`
+			StorageClass string `json:"storageClass"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			f.fail(w, http.StatusBadRequest, "invalid metadata")
+			return
+		}
+		id := strconv.Itoa(len(f.sessions))
+		f.sessions[id] = &gcsTestSession{name: metadata.Name, class: metadata.StorageClass}
+		w.Header().Set("Location", f.server.URL+"/upload/session/"+id)
+	case strings.HasPrefix(path, "/upload/session/"):
+		session := f.sessions[strings.TrimPrefix(path, "/upload/session/")]
+		if session == nil || session.cancelled {
+			f.fail(w, http.StatusNotFound, "no such session")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			session.cancelled = true
+			w.WriteHeader(499)
+			return
+		}
+		f.uploadChunk(w, r, session)
+	case strings.HasPrefix(path, "/storage/v1/b/backups/o/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(path, "/storage/v1/b/backups/o/"))
+		data, ok := f.objects[name]
+		if !ok {
+			f.fail(w, http.StatusNotFound, "No such object: backups/"+name)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("alt") == "media":
+			w.Write(data)
+		case r.Method == http.MethodDelete:
+			delete(f.objects, name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			f.fail(w, http.StatusBadRequest, "unsupported request")
+		}
+	case r.Method == http.MethodGet && path == "/storage/v1/b/backups/o":
+		f.list(w, r.URL.Query())
+	case strings.HasPrefix(path, "/storage/v1/b/"), strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		f.fail(w, http.StatusNotFound, "The specified bucket does not exist.")
+	default:
+		f.fail(w, http.StatusBadRequest, "unsupported request")
+	}
+}
+
+// uploadChunk appends a chunk to a resumable upload. Chunks must arrive in
+// order; the total size is given with the last one, or on its own once a
+// stream has ended on a chunk boundary.
+func (f *fakeGCS) uploadChunk(w http.ResponseWriter, r *http.Request, session *gcsTestSession) {
+	body, _ := io.ReadAll(r.Body)
+	contentRange := r.Header.Get("Content-Range")
+	if len(session.ranges) == f.failChunk {
+		f.fail(w, http.StatusServiceUnavailable, "backend error")
+		return
+	}
+	short := len(session.ranges) == f.shortChunk
+	session.ranges = append(session.ranges, contentRange)
+
+	var first, last int64
+	var total string
+	if n, _ := fmt.Sscanf(contentRange, "bytes */%s", &total); n == 1 {
+		if len(body) != 0 {
+			f.fail(w, http.StatusBadRequest, "unexpected body")
+			return
+		}
+	} else if n, _ := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &first, &last, &total); n == 3 {
+		if first != int64(len(session.data)) || last-first+1 != int64(len(body)) {
+			f.fail(w, http.StatusBadRequest, "invalid Content-Range "+contentRange)
+			return
+		}
+		if total == "*" && len(body)%(256<<10) != 0 {
+			f.fail(w, http.StatusBadRequest, "chunk size is not a multiple of 256 KiB")
+			return
+		}
+		if short {
+			body = body[:len(body)-f.shortBytes]
+		}
+		session.data = append(session.data, body...)
+	} else {
+		f.fail(w, http.StatusBadRequest, "invalid Content-Range "+contentRange)
+		return
+	}
+
+	if total == "*" || f.holdLast {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+	if total != strconv.Itoa(len(session.data)) {
+		f.fail(w, http.StatusBadRequest, "size mismatch in "+contentRange)
+		return
+	}
+	f.objects[session.name] = session.data
+	f.classes[session.name] = session.class
+	json.NewEncoder(w).Encode(map[string]string{"name": session.name, "size": total})
+}
+
+func (f *fakeGCS) list(w http.ResponseWriter, query url.Values) {
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, query.Get("prefix")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(query.Get("pageToken"))
+	end := start + 2
+	next := strconv.Itoa(end)
+	if end >= len(names) {
+		end = len(names)
+		next = ""
+	}
+
+	type item struct {
+		Name    string    `json:"name"`
+		Size    string    `json:"size"`
+		Updated time.Time `json:"updated"`
+	}
+	var items []item
+	for _, name := range names[start:end] {
+		items = append(items, item{Name: name, Size: strconv.Itoa(len(f.objects[name])), Updated: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"items": items, "nextPageToken": next})
+}
+
+func TestGCSStoreOpenListDelete(t *testing.T) {
+	fake := newFakeGCS(t)
+	g := fake.provider(t, GCSOptions{Prefix: "pg/", StorageClass: "NEARLINE"})
+
+	for _, name := range []string{"main/app.sql.gz", "main/crm.sql.gz", "main/wal/0001.gz", "other/app.sql.gz"} {
+		if err := g.Store(name, strings.NewReader("dump of "+name)); err != nil {
+			t.Fatalf("Store(%s): %v", name, err)
+		}
+	}
+	if fake.classes["pg/main/app.sql.gz"] != "NEARLINE" {
+		t.Errorf("storage class = %q, want NEARLINE", fake.classes["pg/main/app.sql.gz"])
+	}
+
+	if got := readObject(t, g, "main/app.sql.gz"); got != "dump of main/app.sql.gz" {
+		t.Errorf("Open returned %q", got)
+	}
+	if _, err := g.Open("main/missing.sql.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of a missing object returned %v, want ErrNotFound", err)
+	}
+
+	objects, err := g.List("main/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if want := "main/app.sql.gz,main/crm.sql.gz,main/wal/0001.gz"; strings.Join(names, ",") != want {
+		t.Errorf("List returned %v, want %s", names, want)
+	}
+	if objects[0].Size != int64(len("dump of main/app.sql.gz")) || objects[0].ModTime.IsZero() {
+		t.Errorf("List returned size %d and time %v", objects[0].Size, objects[0].ModTime)
+	}
+
+	if err := g.Delete("main/app.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := g.Delete("main/app.sql.gz"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+	if _, ok := fake.objects["pg/main/app.sql.gz"]; ok {
+		t.Error("object still exists after Delete")
+	}
+
+	// Every request above shared one access token.
+	if fake.tokens != 1 {
+		t.Errorf("requested %d access tokens, want 1", fake.tokens)
+	}
+}
+
+func TestGCSTokenRefresh(t *testing.T) {
+	fake := newFakeGCS(t)
+	g := fake.provider(t, GCSOptions{})
+
+	if _, err := g.List(""); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	g.tokenExpiry = time.Now().Add(-time.Second)
+	if _, err := g.List(""); err != nil {
+		t.Fatalf("List after the token expired: %v", err)
+	}
+	if fake.tokens != 2 {
+		t.Errorf("requested %d access tokens, want 2", fake.tokens)
+	}
+}
+
+func TestGCSChunkedUpload(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		ranges []string
+	}{
+		{"empty", 0, []string{"bytes */0"}},
+		{"single chunk", 1000, []string{"bytes 0-999/1000"}},
+		{"partial last chunk", gcsChunkSize + 1000, []string{
+			fmt.Sprintf("bytes 0-%d/*", gcsChunkSize-1),
+			fmt.Sprintf("bytes %d-%d/%d", gcsChunkSize, gcsChunkSize+999, gcsChunkSize+1000),
+		}},
+		{"exact multiple", 2 * gcsChunkSize, []string{
+			fmt.Sprintf("bytes 0-%d/*", gcsChunkSize-1),
+			fmt.Sprintf("bytes %d-%d/*", gcsChunkSize, 2*gcsChunkSize-1),
+			fmt.Sprintf("bytes */%d", 2*gcsChunkSize),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeGCS(t)
+			g := fake.provider(t, GCSOptions{})
+
+			data := make([]byte, tt.size)
+			rand.Read(data)
+			if err := g.Store("basebackup.tar.gz", bytes.NewReader(data)); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			stored, ok := fake.objects["basebackup.tar.gz"]
+			if !ok || !bytes.Equal(stored, data) {
+				t.Fatalf("stored %d bytes (finalized: %v), want %d", len(stored), ok, len(data))
+			}
+			if got := fake.sessions["0"].ranges; strings.Join(got, ",") != strings.Join(tt.ranges, ",") {
+				t.Errorf("sent ranges %q, want %q", got, tt.ranges)
+			}
+		})
+	}
+}
+
+// failingReader returns data and then an error, like a dump process that
+// dies part-way.
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("pg_basebackup failed")
+	}
+	return n, err
+}
+
+func TestGCSPartialChunk(t *testing.T) {
+	fake := newFakeGCS(t)
+	fake.shortChunk = 0
+	fake.shortBytes = 256 << 10
+	g := fake.provider(t, GCSOptions{})
+
+	data := make([]byte, gcsChunkSize+1000)
+	rand.Read(data)
+	if err := g.Store("basebackup.tar.gz", bytes.NewReader(data)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if stored := fake.objects["basebackup.tar.gz"]; !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes, want %d", len(stored), len(data))
+	}
+	resent := int64(gcsChunkSize - 256<<10)
+	want := []string{
+		fmt.Sprintf("bytes 0-%d/*", gcsChunkSize-1),
+		fmt.Sprintf("bytes %d-%d/%d", resent, gcsChunkSize+999, gcsChunkSize+1000),
+	}
+	if got := fake.sessions["0"].ranges; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("sent ranges %q, want %q", got, want)
+	}
+}
+
+func TestGCSIncompleteUpload(t *testing.T) {
+	fake := newFakeGCS(t)
+	fake.holdLast = true
+	g := fake.provider(t, GCSOptions{})
+
+	err := g.Store("basebackup.tar.gz", bytes.NewReader(make([]byte, 1000)))
+	if err == nil || !strings.Contains(err.Error(), "not completed") {
+		t.Fatalf("Store returned %v, want an incomplete upload error", err)
+	}
+	if !fake.sessions["0"].cancelled {
+		t.Error("upload session was not cancelled")
+	}
+}
+
+func TestGCSCancelOnError(t *testing.T) {
+	t.Run("reader error", func(t *testing.T) {
+		fake := newFakeGCS(t)
+		g := fake.provider(t, GCSOptions{})
+
+		data := &failingReader{data: bytes.NewReader(make([]byte, gcsChunkSize+1000))}
+		if err := g.Store("basebackup.tar.gz", data); err == nil || !strings.Contains(err.Error(), "pg_basebackup failed") {
+			t.Fatalf("Store returned %v, want the reader's error", err)
+		}
+		if !fake.sessions["0"].cancelled {
+			t.Error("upload session was not cancelled")
+		}
+		if _, ok := fake.objects["basebackup.tar.gz"]; ok {
+			t.Error("a partial object was finalized")
+		}
+	})
+
+	t.Run("chunk error", func(t *testing.T) {
+		fake := newFakeGCS(t)
+		fake.failChunk = 1
+		g := fake.provider(t, GCSOptions{})
+
+		err := g.Store("basebackup.tar.gz", bytes.NewReader(make([]byte, 2*gcsChunkSize+1000)))
+		if err == nil || !strings.Contains(err.Error(), "backend error") {
+			t.Fatalf("Store returned %v, want the service's error", err)
+		}
+		if !fake.sessions["0"].cancelled {
+			t.Error("upload session was not cancelled")
+		}
+	})
+}
+
+func TestGCSErrors(t *testing.T) {
+	fake := newFakeGCS(t)
+	g := fake.provider(t, GCSOptions{})
+	g.bucket = "missing"
+
+	if err := g.Store("app.sql.gz", strings.NewReader("dump")); err == nil || !strings.Contains(err.Error(), "bucket missing not found") {
+		t.Errorf("Store to a missing bucket returned %v", err)
+	}
+	if _, err := g.List(""); err == nil || !strings.Contains(err.Error(), "bucket missing not found") {
+		t.Errorf("List of a missing bucket returned %v", err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g = fake.provider(t, GCSOptions{})
+	g.account.key = other
+	if _, err := g.List(""); err == nil || !strings.Contains(err.Error(), "invalid assertion") {
+		t.Errorf("List with a key the service does not know returned %v", err)
+	}
+}
+
+func TestGCSRequiresCredentials(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+
+	if _, err := NewGCS(GCSOptions{Bucket: "backups"}); err == nil {
+		t.Error("NewGCS without credentials succeeded")
+	}
+	g, err := NewGCS(GCSOptions{Bucket: "backups", Endpoint: "http://127.0.0.1:4443"})
+	if err != nil || g.account != nil {
+		t.Errorf("NewGCS against a custom endpoint returned %v, %v; want an unauthenticated provider", g, err)
+	}
+}
@@ -1,36 +1,167 @@
 package storage
 
 import (
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-type Provider interface {
-	Store(filename string, data io.Reader) error
+// LocalOptions configures a local directory provider.
+type LocalOptions struct {
+	Path string
+	// FileMode and DirMode are the permissions of stored files and of the
+	// directories created for them; they default to 0644 and 0755.
+	FileMode fs.FileMode
+	DirMode  fs.FileMode
+	// MinFreeSpace is the number of bytes that must remain free on the
+	// file system after a backup of known size is written.
+	MinFreeSpace int64
 }
 
 type Local struct {
-	basePath string
+	basePath     string
+	fileMode     fs.FileMode
+	dirMode      fs.FileMode
+	minFreeSpace int64
 }
 
-func NewLocal(basePath string) *Local {
-	return &Local{basePath: basePath}
+func NewLocal(options LocalOptions) *Local {
+	l := &Local{
+		basePath:     options.Path,
+		fileMode:     options.FileMode,
+		dirMode:      options.DirMode,
+		minFreeSpace: options.MinFreeSpace,
+	}
+	if l.fileMode == 0 {
+		l.fileMode = 0644
+	}
+	if l.dirMode == 0 {
+		l.dirMode = 0755
+	}
+	return l
 }
 
+// Store writes to a temporary file in the target directory and renames it
+// into place once the data is synced to disk, so a crash or a full disk
+// never leaves a truncated backup under the real name.
 func (l *Local) Store(filename string, data io.Reader) error {
-	err := os.MkdirAll(l.basePath, 0755)
-	if err != nil {
+	filePath := filepath.Join(l.basePath, filename)
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, l.dirMode); err != nil {
+		return err
+	}
+	if err := l.checkFreeSpace(dir, data); err != nil {
 		return err
 	}
 
-	filePath := filepath.Join(l.basePath, filename)
-	file, err := os.Create(filePath)
+	file, err := os.CreateTemp(dir, "."+filepath.Base(filePath)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	tmp := file.Name()
+	fail := func(err error) error {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := file.Chmod(l.fileMode); err != nil {
+		return fail(err)
+	}
+	if _, err := io.Copy(file, data); err != nil {
+		return fail(err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
 
-	_, err = io.Copy(file, data)
+// checkFreeSpace fails before anything is written when the file system
+// holding dir has less than the minimum free space left, counting the size
+// of data when it is known in advance.
+func (l *Local) checkFreeSpace(dir string, data io.Reader) error {
+	required := l.minFreeSpace
+	if sized, ok := data.(interface{ Len() int }); ok {
+		required += int64(sized.Len())
+	}
+	if required == 0 {
+		return nil
+	}
+
+	available, ok, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check free space in %s: %w", dir, err)
+	}
+	if ok && available < required {
+		return fmt.Errorf("not enough free space in %s: %d bytes available, %d needed", dir, available, required)
+	}
+	return nil
+}
+
+func (l *Local) Open(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(l.basePath, filename))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+func (l *Local) List(prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(l.basePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == l.basePath {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if isTempFile(entry.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.basePath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (l *Local) Delete(filename string) error {
+	err := os.Remove(filepath.Join(l.basePath, filename))
+	if os.IsNotExist(err) {
+		return nil
+	}
 	return err
 }
+
+// isTempFile reports whether name is a partial write left by Store.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp")
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+// freeSpace is not implemented on this platform; the free space check is
+// skipped.
+func freeSpace(dir string) (int64, bool, error) {
+	return 0, false, nil
+}
+
+// syncDir is a no-op where directories cannot be opened for syncing.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system holding dir.
+func freeSpace(dir string) (int64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), true, nil
+}
+
+// syncDir flushes a directory entry, making a rename into it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
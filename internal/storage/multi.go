@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Target is one named destination of a Multi provider.
+type Target struct {
+	Name     string
+	Provider Provider
+}
+
+// Multi writes every object to several providers at once. Reads are served
+// by the first provider that has the object, so a copy missing from one
+// destination after a partial failure is still found on another.
+type Multi struct {
+	targets    []Target
+	requireAll bool
+
+	mu     sync.RWMutex
+	report func(target, filename string, err error)
+}
+
+// NewMulti returns a provider writing to every target. With requireAll a
+// store fails when any target fails; otherwise it succeeds as long as one
+// target stored the object.
+func NewMulti(targets []Target, requireAll bool) *Multi {
+	return &Multi{targets: targets, requireAll: requireAll}
+}
+
+// Targets returns the destinations of the provider.
+func (m *Multi) Targets() []Target {
+	return m.targets
+}
+
+// Subset returns a provider writing only to the named targets, under the
+// same policy and reporting to the same function.
+func (m *Multi) Subset(names []string) *Multi {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	subset := &Multi{requireAll: m.requireAll, report: m.report}
+	for _, target := range m.targets {
+		for _, name := range names {
+			if target.Name == name {
+				subset.targets = append(subset.targets, target)
+			}
+		}
+	}
+	return subset
+}
+
+// SetReporter registers a function that is told the outcome of every
+// store on every target.
+func (m *Multi) SetReporter(report func(target, filename string, err error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.report = report
+}
+
+func (m *Multi) reportStore(target, filename string, err error) {
+	m.mu.RLock()
+	report := m.report
+	m.mu.RUnlock()
+	if report != nil {
+		report(target, filename, err)
+	}
+}
+
+// errTargetsFailed stops copying once the remaining targets can no longer
+// satisfy the policy.
+var errTargetsFailed = errors.New("storing failed on the destinations")
+
+// errShortRead is the failure of a target that returned without error
+// before taking all of the data.
+var errShortRead = errors.New("stopped reading before the end of the data")
+
+// Store streams data to every target concurrently, reading it only once.
+func (m *Multi) Store(filename string, data io.Reader) error {
+	return m.StoreWithMetadata(filename, data, nil)
+}
+
+// StoreWithMetadata is Store passing metadata on to the targets that can
+// keep it.
+func (m *Multi) StoreWithMetadata(filename string, data io.Reader, metadata Metadata) error {
+	if len(m.targets) == 1 {
+		err := StoreWithMetadata(m.targets[0].Provider, filename, data, metadata)
+		m.reportStore(m.targets[0].Name, filename, err)
+		return err
+	}
+
+	writers := make([]*io.PipeWriter, len(m.targets))
+	errs := make([]error, len(m.targets))
+	var wg sync.WaitGroup
+	for i, target := range m.targets {
+		pipeReader, pipeWriter := io.Pipe()
+		writers[i] = pipeWriter
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			err := StoreWithMetadata(target.Provider, filename, pipeReader, metadata)
+			if err != nil {
+				// Unblock the fan-out writer.
+				pipeReader.CloseWithError(err)
+			} else {
+				pipeReader.Close()
+			}
+			errs[i] = err
+		}(i, target)
+	}
+
+	fanout := &fanoutWriter{writers: writers, failed: make([]bool, len(writers)), requireAll: m.requireAll}
+	_, copyErr := io.Copy(fanout, data)
+	for _, writer := range writers {
+		if copyErr != nil {
+			writer.CloseWithError(copyErr)
+		} else {
+			writer.Close()
+		}
+	}
+	wg.Wait()
+	for i := range errs {
+		if errs[i] == nil && fanout.failed[i] {
+			errs[i] = errShortRead
+		}
+	}
+
+	// A failing source is not the destinations' fault; report it as is so
+	// callers can recognise their own error.
+	if copyErr != nil && !errors.Is(copyErr, errTargetsFailed) {
+		return copyErr
+	}
+
+	var failures []error
+	for i, target := range m.targets {
+		m.reportStore(target.Name, filename, errs[i])
+		if errs[i] != nil {
+			failures = append(failures, fmt.Errorf("destination %s: %w", target.Name, errs[i]))
+		}
+	}
+	if len(failures) == 0 || (!m.requireAll && len(failures) < len(m.targets)) {
+		return nil
+	}
+	return errors.Join(failures...)
+}
+
+// fanoutWriter writes to every pipe that is still accepting data.
+type fanoutWriter struct {
+	writers    []*io.PipeWriter
+	failed     []bool
+	requireAll bool
+}
+
+func (f *fanoutWriter) Write(p []byte) (int, error) {
+	live := 0
+	for i, writer := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+		if _, err := writer.Write(p); err != nil {
+			f.failed[i] = true
+			if f.requireAll {
+				return 0, errTargetsFailed
+			}
+			continue
+		}
+		live++
+	}
+	if live == 0 {
+		return 0, errTargetsFailed
+	}
+	return len(p), nil
+}
+
+// Open returns the object from the first target that has it.
+func (m *Multi) Open(filename string) (io.ReadCloser, error) {
+	var errs []error
+	for _, target := range m.targets {
+		reader, err := target.Provider.Open(filename)
+		if err == nil {
+			return reader, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("destination %s: %w", target.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrNotFound
+}
+
+// List returns the objects found on any target. An object stored on
+// several targets is listed once, as found on the first of them.
+func (m *Multi) List(prefix string) ([]Object, error) {
+	if len(m.targets) == 1 {
+		return m.targets[0].Provider.List(prefix)
+	}
+
+	seen := make(map[string]bool)
+	var objects []Object
+	for _, target := range m.targets {
+		targetObjects, err := target.Provider.List(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("destination %s: %w", target.Name, err)
+		}
+		for _, object := range targetObjects {
+			if !seen[object.Name] {
+				seen[object.Name] = true
+				objects = append(objects, object)
+			}
+		}
+	}
+	return objects, nil
+}
+
+// Delete removes the object from every target.
+func (m *Multi) Delete(filename string) error {
+	var errs []error
+	for _, target := range m.targets {
+		if err := target.Provider.Delete(filename); err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", target.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every target that holds connections.
+func (m *Multi) Close() error {
+	var errs []error
+	for _, target := range m.targets {
+		if err := Close(target.Provider); err != nil {
+			errs = append(errs, fmt.Errorf("destination %s: %w", target.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
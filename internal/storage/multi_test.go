@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// closeCounter is a provider that records how often it is closed.
+type closeCounter struct {
+	Provider
+	closed int
+	err    error
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return c.err
+}
+
+func TestMultiClose(t *testing.T) {
+	plain := NewLocal(LocalOptions{Path: t.TempDir()})
+	first := &closeCounter{Provider: NewLocal(LocalOptions{Path: t.TempDir()})}
+	second := &closeCounter{Provider: NewLocal(LocalOptions{Path: t.TempDir()}), err: errors.New("connection reset")}
+	multi := NewMulti([]Target{{"plain", plain}, {"first", first}, {"second", second}}, true)
+
+	err := Close(multi)
+	if first.closed != 1 || second.closed != 1 {
+		t.Errorf("closed targets %d and %d times, want once each", first.closed, second.closed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "destination second: connection reset") {
+		t.Errorf("Close returned %v, want the error of destination second", err)
+	}
+}
+
+// shortReader is a provider that stores only the first bytes of an object
+// and reports success.
+type shortReader struct {
+	Provider
+}
+
+func (s shortReader) Store(filename string, data io.Reader) error {
+	buf := make([]byte, 16)
+	_, err := io.ReadFull(data, buf)
+	return err
+}
+
+func TestMultiStoreShortRead(t *testing.T) {
+	for _, requireAll := range []bool{true, false} {
+		t.Run(fmt.Sprintf("requireAll=%v", requireAll), func(t *testing.T) {
+			full := NewLocal(LocalOptions{Path: t.TempDir()})
+			multi := NewMulti([]Target{{"full", full}, {"short", shortReader{full}}}, requireAll)
+			reported := make(map[string]error)
+			multi.SetReporter(func(target, filename string, err error) {
+				reported[target] = err
+			})
+
+			data := bytes.Repeat([]byte("0123456789"), 100000)
+			err := multi.Store("backup.gz", bytes.NewReader(data))
+			if requireAll && (err == nil || !strings.Contains(err.Error(), "destination short: stopped reading")) {
+				t.Errorf("Store returned %v, want the short read of destination short", err)
+			}
+			if !requireAll && err != nil {
+				t.Errorf("Store returned %v, want success from destination full", err)
+			}
+			if !errors.Is(reported["short"], errShortRead) {
+				t.Errorf("reported %v for destination short, want %v", reported["short"], errShortRead)
+			}
+			if !requireAll && reported["full"] != nil {
+				t.Errorf("reported %v for destination full", reported["full"])
+			}
+		})
+	}
+}
@@ -2,54 +2,317 @@ package storage
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
 	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// S3Options configures an S3 provider.
+type S3Options struct {
+	Bucket   string
+	Region   string
+	Endpoint string
+	// AccessKey and SecretKey are static credentials. When they are empty
+	// the standard AWS credential chain is used instead: environment
+	// variables, the shared credentials file and finally the EC2/ECS
+	// instance metadata service.
+	AccessKey string
+	SecretKey string
+	// ForcePathStyle addresses buckets as endpoint/bucket instead of
+	// bucket.endpoint, as MinIO and Ceph RGW usually need.
+	ForcePathStyle bool
+	// DisableSSL talks plain HTTP to an endpoint given without a scheme.
+	DisableSSL bool
+	// CACert is a PEM file with the certificates the endpoint's certificate
+	// may be signed by. It replaces the system roots rather than adding to
+	// them, as AWS_CA_BUNDLE does.
+	CACert string
+
+	// ServerSideEncryption is "AES256" (SSE-S3) or "aws:kms" (SSE-KMS, with
+	// the optional KMSKeyID); empty leaves it to the bucket's default.
+	ServerSideEncryption string
+	KMSKeyID             string
+	// SSECustomerKey is the raw 32-byte key for SSE-C. It is needed again
+	// to read the objects back.
+	SSECustomerKey string
+	// StorageClass is set on uploaded objects, e.g. STANDARD_IA.
+	StorageClass string
+	// Tags are set on every uploaded object.
+	Tags map[string]string
+	// ACL is a canned ACL such as bucket-owner-full-control.
+	ACL string
+	// ExpectedBucketOwner is the account ID the bucket must belong to;
+	// requests fail if it belongs to another account.
+	ExpectedBucketOwner string
+
+	// ObjectLockMode is GOVERNANCE or COMPLIANCE. Uploads are then locked
+	// against deletion for ObjectLockPeriod.
+	ObjectLockMode   string
+	ObjectLockPeriod time.Duration
+	// LegalHold places a legal hold on every upload; it stays until it is
+	// removed by hand.
+	LegalHold bool
+}
+
 type S3 struct {
-	client *s3.S3
-	bucket string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	options  S3Options
 }
 
-func NewS3(bucket, region, endpoint, accessKey, secretKey string) (*S3, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Endpoint:    aws.String(endpoint),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
-	})
+func NewS3(options S3Options) (*S3, error) {
+	awsConfig := &aws.Config{
+		Region:           aws.String(options.Region),
+		Endpoint:         aws.String(options.Endpoint),
+		S3ForcePathStyle: aws.Bool(options.ForcePathStyle),
+		DisableSSL:       aws.Bool(options.DisableSSL),
+	}
+	if options.AccessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(options.AccessKey, options.SecretKey, "")
+	}
+
+	sessionOptions := session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if options.CACert != "" {
+		// Like AWS_CA_BUNDLE, the bundle replaces the system roots.
+		bundle, err := os.ReadFile(options.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		sessionOptions.CustomCABundle = bytes.NewReader(bundle)
+	}
+	// The session installs a CA bundle, from ca_cert or $AWS_CA_BUNDLE, in
+	// the client's transport; without a client of our own that would be
+	// http.DefaultClient's.
+	sessionOptions.Config.HTTPClient = &http.Client{}
+
+	sess, err := session.NewSessionWithOptions(sessionOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	return &S3{
-		client: s3.New(sess),
-		bucket: bucket,
-	}, nil
+	client := s3.New(sess)
+	s3Provider := &S3{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   options.Bucket,
+		options:  options,
+	}
+	if s3Provider.locking() {
+		client.Handlers.Build.PushBack(addContentMD5)
+	}
+	return s3Provider, nil
 }
 
+// addContentMD5 sets Content-MD5 on uploads, which S3 requires when an
+// object is stored with Object Lock settings. The uploader buffers each
+// part, so the body can be read twice.
+func addContentMD5(r *request.Request) {
+	if r.Operation.Name != "PutObject" && r.Operation.Name != "UploadPart" || r.Body == nil {
+		return
+	}
+	start, err := r.Body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		r.Error = err
+		return
+	}
+	hash := md5.New()
+	if _, err := io.Copy(hash, r.Body); err != nil {
+		r.Error = err
+		return
+	}
+	if _, err := r.Body.Seek(start, io.SeekStart); err != nil {
+		r.Error = err
+		return
+	}
+	r.HTTPRequest.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(hash.Sum(nil)))
+}
+
+// Store uploads data as it is read, using a multipart upload for large
+// objects, so backups do not need to fit in memory.
 func (s *S3) Store(filename string, data io.Reader) error {
-	// Convert io.Reader to bytes.Reader to ensure proper seeking behavior for S3
-	var body io.ReadSeeker
-	if buf, ok := data.(*bytes.Buffer); ok {
-		// If it's a bytes.Buffer, create a bytes.Reader from its contents
-		body = bytes.NewReader(buf.Bytes())
-	} else {
-		// For other readers, read all data and create bytes.Reader
-		allData, err := io.ReadAll(data)
+	return s.StoreWithMetadata(filename, data, nil)
+}
+
+// StoreWithMetadata uploads data like Store and keeps metadata as user
+// metadata (x-amz-meta-*) on the object.
+func (s *S3) StoreWithMetadata(filename string, data io.Reader, metadata Metadata) error {
+	input := &s3manager.UploadInput{
+		Bucket:               aws.String(s.bucket),
+		Key:                  aws.String(filename),
+		Body:                 data,
+		ExpectedBucketOwner:  optionalString(s.options.ExpectedBucketOwner),
+		ServerSideEncryption: optionalString(s.options.ServerSideEncryption),
+		SSEKMSKeyId:          optionalString(s.options.KMSKeyID),
+		StorageClass:         optionalString(s.options.StorageClass),
+		ACL:                  optionalString(s.options.ACL),
+	}
+	if s.options.SSECustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.options.SSECustomerKey)
+	}
+	if len(s.options.Tags) > 0 {
+		tags := url.Values{}
+		for key, value := range s.options.Tags {
+			tags.Set(key, value)
+		}
+		// S3 expects spaces in tags as %20 rather than +.
+		input.Tagging = aws.String(strings.ReplaceAll(tags.Encode(), "+", "%20"))
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	if s.options.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(s.options.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(s.options.ObjectLockPeriod))
+	}
+	if s.options.LegalHold {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+
+	_, err := s.uploader.Upload(input)
+	return err
+}
+
+// optionalString returns nil for an empty setting so it is left out of requests.
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+func (s *S3) Open(filename string) (io.ReadCloser, error) {
+	input := &s3.GetObjectInput{
+		Bucket:              aws.String(s.bucket),
+		Key:                 aws.String(filename),
+		ExpectedBucketOwner: optionalString(s.options.ExpectedBucketOwner),
+	}
+	if s.options.SSECustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(s.options.SSECustomerKey)
+	}
+	output, err := s.client.GetObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return output.Body, nil
+}
+
+func (s *S3) List(prefix string) ([]Object, error) {
+	var objects []Object
+	err := s.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:              aws.String(s.bucket),
+		Prefix:              aws.String(prefix),
+		ExpectedBucketOwner: optionalString(s.options.ExpectedBucketOwner),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, Object{
+				Name:    aws.StringValue(object.Key),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// Delete removes an object with all of its versions. Every version is
+// looked up first, whether or not this configuration locks uploads: the
+// bucket may apply a default retention, or a version may have been locked
+// by an earlier configuration. If any version is locked the object is left
+// alone and ErrLocked returned; otherwise every version and delete marker
+// is deleted by version ID, since deleting a versioned object by name would
+// only hide it behind a delete marker.
+func (s *S3) Delete(filename string) error {
+	var versions, markers []*string
+	err := s.client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket:              aws.String(s.bucket),
+		Prefix:              aws.String(filename),
+		ExpectedBucketOwner: optionalString(s.options.ExpectedBucketOwner),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			if aws.StringValue(version.Key) == filename {
+				versions = append(versions, version.VersionId)
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			if aws.StringValue(marker.Key) == filename {
+				markers = append(markers, marker.VersionId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, versionID := range versions {
+		if err := s.checkUnlocked(filename, versionID); err != nil {
+			return err
+		}
+	}
+	for _, versionID := range append(versions, markers...) {
+		_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket:              aws.String(s.bucket),
+			Key:                 aws.String(filename),
+			VersionId:           versionID,
+			ExpectedBucketOwner: optionalString(s.options.ExpectedBucketOwner),
+		})
 		if err != nil {
 			return err
 		}
-		body = bytes.NewReader(allData)
 	}
+	return nil
+}
 
-	_, err := s.client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(filename),
-		Body:   body,
-	})
-	return err
+// checkUnlocked returns ErrLocked if a version of an object is under a
+// legal hold or retained.
+func (s *S3) checkUnlocked(filename string, versionID *string) error {
+	headInput := &s3.HeadObjectInput{
+		Bucket:              aws.String(s.bucket),
+		Key:                 aws.String(filename),
+		VersionId:           versionID,
+		ExpectedBucketOwner: optionalString(s.options.ExpectedBucketOwner),
+	}
+	if s.options.SSECustomerKey != "" {
+		headInput.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		headInput.SSECustomerKey = aws.String(s.options.SSECustomerKey)
+	}
+	head, err := s.client.HeadObject(headInput)
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(head.ObjectLockLegalHoldStatus) == s3.ObjectLockLegalHoldStatusOn {
+		return fmt.Errorf("%w by a legal hold", ErrLocked)
+	}
+	if until := aws.TimeValue(head.ObjectLockRetainUntilDate); until.After(time.Now()) {
+		return fmt.Errorf("%w until %s", ErrLocked, until.Local().Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+func (s *S3) locking() bool {
+	return s.options.ObjectLockMode != "" || s.options.LegalHold
 }
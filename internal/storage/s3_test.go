@@ -0,0 +1,778 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	s3TestBucket    = "pg-backups"
+	s3TestAccessKey = "test-access-key"
+	s3TestOwner     = "123456789012"
+)
+
+// fakeS3 is a MinIO-compatible stand-in for an S3 bucket, addressed
+// path-style. It keeps object versions, Object Lock settings and SSE-C key
+// digests, and rejects uploads the way S3 does: a wrong Content-MD5, or a
+// locked upload without one.
+type fakeS3 struct {
+	t *testing.T
+	// versioning keeps every version and turns deletes by name into delete
+	// markers.
+	versioning bool
+	// defaultRetention locks every new object, like a bucket's default
+	// Object Lock retention.
+	defaultRetention time.Duration
+
+	mu          sync.Mutex
+	objects     map[string][]*s3TestVersion
+	uploads     map[string]*s3TestUpload
+	requests    []s3TestRequest
+	nextVersion int
+}
+
+type s3TestVersion struct {
+	id          string
+	data        []byte
+	header      http.Header
+	marker      bool
+	retainUntil time.Time
+	legalHold   bool
+	sseKeyMD5   string
+}
+
+type s3TestUpload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+type s3TestRequest struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	return &fakeS3{
+		t:       t,
+		objects: make(map[string][]*s3TestVersion),
+		uploads: make(map[string]*s3TestUpload),
+	}
+}
+
+// startHTTP serves the fake over plain HTTP and returns a provider for it.
+func (f *fakeS3) startHTTP(t *testing.T, options S3Options) *S3 {
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	options.Endpoint = strings.TrimPrefix(server.URL, "http://")
+	options.DisableSSL = true
+	return f.provider(t, options)
+}
+
+// startTLS serves the fake over HTTPS with a self-signed certificate and
+// returns a provider trusting it through CACert.
+func (f *fakeS3) startTLS(t *testing.T, options S3Options) *S3 {
+	server := httptest.NewTLSServer(f)
+	t.Cleanup(server.Close)
+	options.Endpoint = server.URL
+	options.CACert = writeCACert(t, server)
+	return f.provider(t, options)
+}
+
+func writeCACert(t *testing.T, server *httptest.Server) string {
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (f *fakeS3) provider(t *testing.T, options S3Options) *S3 {
+	options.Bucket = s3TestBucket
+	options.Region = "us-east-1"
+	options.AccessKey = s3TestAccessKey
+	options.SecretKey = "test-secret-key"
+	options.ForcePathStyle = true
+	s, err := NewS3(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><Resource>%s</Resource></Error>`, code, code, r.URL.Path)
+	}
+}
+
+// latest returns the current version of key, or nil if it does not exist
+// or was deleted.
+func (f *fakeS3) latest(key string) *s3TestVersion {
+	versions := f.objects[key]
+	if len(versions) == 0 || versions[len(versions)-1].marker {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
+
+// version returns the version of key with the given ID. An unversioned
+// bucket has a single version called "null".
+func (f *fakeS3) version(key, versionID string) *s3TestVersion {
+	for _, version := range f.objects[key] {
+		if f.versionID(version) == versionID {
+			return version
+		}
+	}
+	return nil
+}
+
+// versionID returns the ID S3 reports for a version.
+func (f *fakeS3) versionID(version *s3TestVersion) string {
+	if !f.versioning {
+		return "null"
+	}
+	return version.id
+}
+
+// put stores a new version of key, replacing the old one unless the
+// bucket is versioned.
+func (f *fakeS3) put(key string, data []byte, header http.Header) {
+	f.nextVersion++
+	version := &s3TestVersion{
+		id:        "v" + strconv.Itoa(f.nextVersion),
+		data:      data,
+		header:    header,
+		legalHold: header.Get("X-Amz-Object-Lock-Legal-Hold") == "ON",
+		sseKeyMD5: header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5"),
+	}
+	if until := header.Get("X-Amz-Object-Lock-Retain-Until-Date"); until != "" {
+		version.retainUntil, _ = time.Parse(time.RFC3339, until)
+	} else if f.defaultRetention > 0 {
+		version.retainUntil = time.Now().Add(f.defaultRetention)
+	}
+	if f.versioning {
+		f.objects[key] = append(f.objects[key], version)
+	} else {
+		f.objects[key] = []*s3TestVersion{version}
+	}
+}
+
+// locked reports whether an upload is subject to Object Lock, in which case
+// S3 requires Content-MD5.
+func (f *fakeS3) locked(header http.Header) bool {
+	return f.defaultRetention > 0 || header.Get("X-Amz-Object-Lock-Mode") != "" || header.Get("X-Amz-Object-Lock-Legal-Hold") != ""
+}
+
+// checkMD5 verifies a body against its Content-MD5 header.
+func checkMD5(header http.Header, body []byte, required bool) string {
+	digest := header.Get("Content-Md5")
+	if digest == "" {
+		if required {
+			return "InvalidRequest"
+		}
+		return ""
+	}
+	sum := md5.Sum(body)
+	if digest != base64.StdEncoding.EncodeToString(sum[:]) {
+		return "BadDigest"
+	}
+	return ""
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, s3TestRequest{method: r.Method, path: r.URL.Path, query: r.URL.Query(), header: r.Header.Clone()})
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+s3TestAccessKey+"/") {
+		f.fail(w, r, http.StatusForbidden, "InvalidAccessKeyId")
+		return
+	}
+	if owner := r.Header.Get("X-Amz-Expected-Bucket-Owner"); owner != "" && owner != s3TestOwner {
+		f.fail(w, r, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	if r.URL.Path != "/"+s3TestBucket && !strings.HasPrefix(r.URL.Path, "/"+s3TestBucket+"/") {
+		f.fail(w, r, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+s3TestBucket), "/")
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		f.list(w, query)
+	case key == "" && r.Method == http.MethodGet && query.Has("versions"):
+		f.listVersions(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		id := fmt.Sprintf("upload-%d", len(f.uploads))
+		f.uploads[id] = &s3TestUpload{key: key, header: r.Header.Clone(), parts: make(map[int][]byte)}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, s3TestBucket, key, id)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			f.fail(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if code := checkMD5(r.Header, body, f.locked(upload.header)); code != "" {
+			f.fail(w, r, http.StatusBadRequest, code)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[number] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			f.fail(w, r, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var complete struct {
+			Parts []struct {
+				PartNumber int `xml:"PartNumber"`
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			f.fail(w, r, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, upload.parts[part.PartNumber]...)
+		}
+		f.put(upload.key, data, upload.header)
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>"multipart"</ETag></CompleteMultipartUploadResult>`, s3TestBucket, upload.key)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		if code := checkMD5(r.Header, body, f.locked(r.Header)); code != "" {
+			f.fail(w, r, http.StatusBadRequest, code)
+			return
+		}
+		f.put(key, body, r.Header.Clone())
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		version := f.latest(key)
+		if query.Has("versionId") {
+			version = f.version(key, query.Get("versionId"))
+		}
+		if version == nil {
+			f.fail(w, r, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if version.sseKeyMD5 != r.Header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") {
+			f.fail(w, r, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		if f.versioning {
+			w.Header().Set("X-Amz-Version-Id", version.id)
+		}
+		if !version.retainUntil.IsZero() {
+			w.Header().Set("X-Amz-Object-Lock-Mode", "GOVERNANCE")
+			w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date", version.retainUntil.UTC().Format(time.RFC3339))
+		}
+		if version.legalHold {
+			w.Header().Set("X-Amz-Object-Lock-Legal-Hold", "ON")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(version.data)))
+		if r.Method == http.MethodGet {
+			w.Write(version.data)
+		}
+	case r.Method == http.MethodDelete:
+		f.delete(w, r, key, query.Get("versionId"))
+	default:
+		f.fail(w, r, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) delete(w http.ResponseWriter, r *http.Request, key, versionID string) {
+	if versionID == "" {
+		if f.versioning {
+			if f.latest(key) != nil {
+				f.nextVersion++
+				f.objects[key] = append(f.objects[key], &s3TestVersion{id: "v" + strconv.Itoa(f.nextVersion), marker: true})
+			}
+		} else {
+			delete(f.objects, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	versions := f.objects[key]
+	for i, version := range versions {
+		if f.versionID(version) != versionID {
+			continue
+		}
+		if version.legalHold || version.retainUntil.After(time.Now()) {
+			f.fail(w, r, http.StatusForbidden, "AccessDenied")
+			return
+		}
+		f.objects[key] = append(versions[:i:i], versions[i+1:]...)
+		if len(f.objects[key]) == 0 {
+			delete(f.objects, key)
+		}
+		break
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list answers ListObjectsV2 two keys at a time, so listings need
+// continuation tokens.
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && f.latest(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	end := start + 2
+	truncated := end < len(keys)
+	if !truncated {
+		end = len(keys)
+	}
+
+	var response bytes.Buffer
+	fmt.Fprintf(&response, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>2</MaxKeys><IsTruncated>%v</IsTruncated>`,
+		s3TestBucket, query.Get("prefix"), end-start, truncated)
+	if truncated {
+		fmt.Fprintf(&response, `<NextContinuationToken>%d</NextContinuationToken>`, end)
+	}
+	for _, key := range keys[start:end] {
+		fmt.Fprintf(&response, `<Contents><Key>%s</Key><LastModified>2024-01-01T00:00:00.000Z</LastModified><Size>%d</Size></Contents>`, key, len(f.latest(key).data))
+	}
+	response.WriteString(`</ListBucketResult>`)
+	w.Write(response.Bytes())
+}
+
+// listVersions answers ListObjectVersions two entries at a time, newest
+// version of each key first. The version-id-marker is the index of the next
+// entry, which is enough for the client to page through.
+func (f *fakeS3) listVersions(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	type entry struct {
+		key     string
+		version *s3TestVersion
+		latest  bool
+	}
+	var entries []entry
+	for _, key := range keys {
+		versions := f.objects[key]
+		for i := len(versions) - 1; i >= 0; i-- {
+			entries = append(entries, entry{key, versions[i], i == len(versions)-1})
+		}
+	}
+
+	start, _ := strconv.Atoi(query.Get("version-id-marker"))
+	end := start + 2
+	truncated := end < len(entries)
+	if !truncated {
+		end = len(entries)
+	}
+
+	var response bytes.Buffer
+	fmt.Fprintf(&response, `<?xml version="1.0" encoding="UTF-8"?><ListVersionsResult><Name>%s</Name><Prefix>%s</Prefix><MaxKeys>2</MaxKeys><IsTruncated>%v</IsTruncated>`,
+		s3TestBucket, query.Get("prefix"), truncated)
+	if truncated {
+		fmt.Fprintf(&response, `<NextKeyMarker>%s</NextKeyMarker><NextVersionIdMarker>%d</NextVersionIdMarker>`, entries[end].key, end)
+	}
+	for _, e := range entries[start:end] {
+		if e.version.marker {
+			fmt.Fprintf(&response, `<DeleteMarker><Key>%s</Key><VersionId>%s</VersionId><IsLatest>%v</IsLatest><LastModified>2024-01-01T00:00:00.000Z</LastModified></DeleteMarker>`,
+				e.key, f.versionID(e.version), e.latest)
+		} else {
+			fmt.Fprintf(&response, `<Version><Key>%s</Key><VersionId>%s</VersionId><IsLatest>%v</IsLatest><LastModified>2024-01-01T00:00:00.000Z</LastModified><Size>%d</Size></Version>`,
+				e.key, f.versionID(e.version), e.latest, len(e.version.data))
+		}
+	}
+	response.WriteString(`</ListVersionsResult>`)
+	w.Write(response.Bytes())
+}
+
+// upload returns the request that created key: its PutObject or
+// CreateMultipartUpload.
+func (f *fakeS3) upload(t *testing.T, key string) s3TestRequest {
+	t.Helper()
+	for _, request := range f.requests {
+		if request.path == "/"+s3TestBucket+"/"+key && (request.method == http.MethodPut && !request.query.Has("partNumber") || request.method == http.MethodPost && request.query.Has("uploads")) {
+			return request
+		}
+	}
+	t.Fatalf("no upload of %s", key)
+	return s3TestRequest{}
+}
+
+func TestS3PathStylePlainHTTP(t *testing.T) {
+	fake := newFakeS3(t)
+	s := fake.startHTTP(t, S3Options{})
+
+	for _, name := range []string{"main/app.sql.gz", "main/crm.sql.gz", "main/wal/0001.gz", "other/app.sql.gz"} {
+		if err := s.Store(name, strings.NewReader("dump of "+name)); err != nil {
+			t.Fatalf("Store(%s): %v", name, err)
+		}
+	}
+	if got := readObject(t, s, "main/app.sql.gz"); got != "dump of main/app.sql.gz" {
+		t.Errorf("Open returned %q", got)
+	}
+	if _, err := s.Open("main/missing.sql.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of a missing object returned %v, want ErrNotFound", err)
+	}
+
+	objects, err := s.List("main/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if want := "main/app.sql.gz,main/crm.sql.gz,main/wal/0001.gz"; strings.Join(names, ",") != want {
+		t.Errorf("List returned %v, want %s", names, want)
+	}
+	if objects[0].Size != int64(len("dump of main/app.sql.gz")) || objects[0].ModTime.IsZero() {
+		t.Errorf("List returned size %d and time %v", objects[0].Size, objects[0].ModTime)
+	}
+
+	if err := s.Delete("main/app.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete("main/app.sql.gz"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+	if _, ok := fake.objects["main/app.sql.gz"]; ok {
+		t.Error("object still exists after Delete")
+	}
+
+	// Every request reached the fake over plain HTTP with the bucket in
+	// the path.
+	for _, request := range fake.requests {
+		if !strings.HasPrefix(request.path, "/"+s3TestBucket) {
+			t.Errorf("%s %s is not path-style", request.method, request.path)
+		}
+	}
+}
+
+func TestS3MultipartUpload(t *testing.T) {
+	fake := newFakeS3(t)
+	s := fake.startHTTP(t, S3Options{})
+
+	// Larger than the uploader's 5 MiB part size, and not seekable.
+	data := make([]byte, 12<<20)
+	rand.Read(data)
+	if err := s.Store("basebackup.tar.gz", io.MultiReader(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if version := fake.latest("basebackup.tar.gz"); version == nil || !bytes.Equal(version.data, data) {
+		t.Fatal("multipart upload was not assembled correctly")
+	}
+	parts := 0
+	for _, request := range fake.requests {
+		if request.query.Has("partNumber") {
+			parts++
+		}
+	}
+	if parts != 3 {
+		t.Errorf("uploaded %d parts, want 3", parts)
+	}
+}
+
+func TestS3CACert(t *testing.T) {
+	fake := newFakeS3(t)
+	s := fake.startTLS(t, S3Options{})
+
+	if err := s.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store over TLS with ca_cert: %v", err)
+	}
+	if got := readObject(t, s, "app.sql.gz"); got != "dump" {
+		t.Errorf("Open returned %q", got)
+	}
+
+	// Without the bundle the self-signed certificate is rejected, and the
+	// bundle given to the first provider has not leaked into the default
+	// HTTP client.
+	options := S3Options{CACert: ""}
+	options.Endpoint = s.client.Endpoint
+	untrusted := fake.provider(t, options)
+	if err := untrusted.Store("app.sql.gz", strings.NewReader("dump")); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("Store without ca_cert returned %v, want a certificate error", err)
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Error("ca_cert changed http.DefaultClient")
+	}
+
+	if _, err := NewS3(S3Options{Bucket: s3TestBucket, Region: "us-east-1", CACert: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("NewS3 with a missing ca_cert succeeded")
+	}
+}
+
+func TestS3UploadSettings(t *testing.T) {
+	fake := newFakeS3(t)
+	s := fake.startTLS(t, S3Options{
+		ServerSideEncryption: "aws:kms",
+		KMSKeyID:             "arn:aws:kms:us-east-1:123456789012:key/backup",
+		StorageClass:         "STANDARD_IA",
+		ACL:                  "bucket-owner-full-control",
+		ExpectedBucketOwner:  s3TestOwner,
+		Tags:                 map[string]string{"environment": "production", "owner": "database team"},
+	})
+
+	metadata := Metadata{"server": "main", "database": "app", "kind": "database"}
+	if err := StoreWithMetadata(s, "main/app.sql.gz", strings.NewReader("dump"), metadata); err != nil {
+		t.Fatalf("StoreWithMetadata: %v", err)
+	}
+
+	header := fake.upload(t, "main/app.sql.gz").header
+	for name, want := range map[string]string{
+		"X-Amz-Server-Side-Encryption":                "aws:kms",
+		"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "arn:aws:kms:us-east-1:123456789012:key/backup",
+		"X-Amz-Storage-Class":                         "STANDARD_IA",
+		"X-Amz-Acl":                                   "bucket-owner-full-control",
+		"X-Amz-Tagging":                               "environment=production&owner=database%20team",
+		"X-Amz-Meta-Server":                           "main",
+		"X-Amz-Meta-Database":                         "app",
+		"X-Amz-Meta-Kind":                             "database",
+	} {
+		if got := header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if header.Get("X-Amz-Object-Lock-Mode") != "" || header.Get("X-Amz-Object-Lock-Legal-Hold") != "" {
+		t.Error("an upload without object_lock carried lock settings")
+	}
+
+	readObject(t, s, "main/app.sql.gz")
+	if _, err := s.List("main/"); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if err := s.Delete("main/app.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, request := range fake.requests {
+		if request.header.Get("X-Amz-Expected-Bucket-Owner") != s3TestOwner {
+			t.Errorf("%s %s did not carry the expected bucket owner", request.method, request.path)
+		}
+	}
+
+	// A bucket owned by another account is refused.
+	s.options.ExpectedBucketOwner = "999999999999"
+	if err := s.Store("main/app.sql.gz", strings.NewReader("dump")); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("Store to a bucket of another owner returned %v", err)
+	}
+}
+
+func TestS3SSECustomerKey(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	fake := newFakeS3(t)
+	s := fake.startTLS(t, S3Options{SSECustomerKey: key})
+
+	if err := s.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	header := fake.upload(t, "app.sql.gz").header
+	sum := md5.Sum([]byte(key))
+	if header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "AES256" ||
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Key") != base64.StdEncoding.EncodeToString([]byte(key)) ||
+		header.Get("X-Amz-Server-Side-Encryption-Customer-Key-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("upload carried SSE-C headers %v", header)
+	}
+
+	if got := readObject(t, s, "app.sql.gz"); got != "dump" {
+		t.Errorf("Open returned %q", got)
+	}
+	if err := s.Delete("app.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if fake.latest("app.sql.gz") != nil {
+		t.Error("object still exists after Delete")
+	}
+}
+
+func TestS3ObjectLockUploads(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.versioning = true
+	s := fake.startTLS(t, S3Options{ObjectLockMode: "GOVERNANCE", ObjectLockPeriod: 30 * 24 * time.Hour, LegalHold: true})
+
+	before := time.Now()
+	if err := s.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	data := make([]byte, 11<<20)
+	rand.Read(data)
+	if err := s.Store("basebackup.tar.gz", io.MultiReader(bytes.NewReader(data))); err != nil {
+		t.Fatalf("Store of a multipart upload: %v", err)
+	}
+
+	for _, key := range []string{"app.sql.gz", "basebackup.tar.gz"} {
+		header := fake.upload(t, key).header
+		if header.Get("X-Amz-Object-Lock-Mode") != "GOVERNANCE" || header.Get("X-Amz-Object-Lock-Legal-Hold") != "ON" {
+			t.Errorf("%s: lock headers %q and %q", key, header.Get("X-Amz-Object-Lock-Mode"), header.Get("X-Amz-Object-Lock-Legal-Hold"))
+		}
+		until, err := time.Parse(time.RFC3339, header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+		if err != nil || until.Before(before.Add(30*24*time.Hour-time.Minute)) || until.After(time.Now().Add(30*24*time.Hour+time.Minute)) {
+			t.Errorf("%s: retain-until %q, want 30 days from now", key, header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+		}
+	}
+
+	// The fake rejects locked uploads and parts without a correct
+	// Content-MD5, so both stores above carried one.
+	parts := 0
+	for _, request := range fake.requests {
+		if request.query.Has("partNumber") {
+			parts++
+			if request.header.Get("Content-Md5") == "" {
+				t.Errorf("part %s had no Content-MD5", request.query.Get("partNumber"))
+			}
+		}
+	}
+	if parts != 3 {
+		t.Errorf("uploaded %d parts, want 3", parts)
+	}
+}
+
+func TestS3DeleteLocked(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.versioning = true
+	s := fake.startHTTP(t, S3Options{ObjectLockMode: "GOVERNANCE", ObjectLockPeriod: time.Hour})
+
+	if err := s.Store("retained.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Delete("retained.sql.gz")
+	if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "until") {
+		t.Errorf("Delete of a retained object returned %v, want ErrLocked", err)
+	}
+
+	s.options.LegalHold = true
+	s.options.ObjectLockPeriod = 0
+	if err := s.Store("held.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("held.sql.gz"); !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "legal hold") {
+		t.Errorf("Delete of an object under legal hold returned %v, want ErrLocked", err)
+	}
+
+	// An expired lock no longer protects the object, and it is deleted
+	// by version rather than hidden behind a delete marker.
+	fake.latest("retained.sql.gz").retainUntil = time.Now().Add(-time.Minute)
+	if err := s.Delete("retained.sql.gz"); err != nil {
+		t.Fatalf("Delete after the lock expired: %v", err)
+	}
+	if versions := fake.objects["retained.sql.gz"]; len(versions) != 0 {
+		t.Errorf("%d versions left after Delete, want none", len(versions))
+	}
+}
+
+// TestS3DeleteWithoutObjectLockSetting covers buckets that lock or version
+// objects on their own: objects must be checked and deleted by version
+// even when the configuration has no object_lock section.
+func TestS3DeleteWithoutObjectLockSetting(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.versioning = true
+	s := fake.startHTTP(t, S3Options{})
+
+	if err := s.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("app.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if versions := fake.objects["app.sql.gz"]; len(versions) != 0 {
+		t.Errorf("%d versions left after Delete on a versioned bucket, want none", len(versions))
+	}
+
+	// Objects uploaded with a lock by an earlier configuration.
+	fake.put("locked.sql.gz", []byte("dump"), http.Header{"X-Amz-Object-Lock-Retain-Until-Date": {time.Now().Add(time.Hour).UTC().Format(time.RFC3339)}})
+	if err := s.Delete("locked.sql.gz"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Delete of an object locked by an earlier configuration returned %v, want ErrLocked", err)
+	}
+}
+
+func TestS3DeleteAllVersions(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.versioning = true
+	s := fake.startHTTP(t, S3Options{})
+
+	// Two versions, a delete marker and a neighbour sharing the prefix.
+	for _, data := range []string{"first", "second"} {
+		if err := s.Store("app.sql.gz", strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Store("app.sql.gz.manifest.json", strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("app.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if versions := fake.objects["app.sql.gz"]; len(versions) != 0 {
+		t.Errorf("%d versions left after Delete, want none", len(versions))
+	}
+	if fake.latest("app.sql.gz.manifest.json") == nil {
+		t.Error("Delete removed another object sharing the prefix")
+	}
+
+	// An older locked version keeps the whole object.
+	fake.put("locked.sql.gz", []byte("old"), http.Header{"X-Amz-Object-Lock-Retain-Until-Date": {time.Now().Add(time.Hour).UTC().Format(time.RFC3339)}})
+	fake.put("locked.sql.gz", []byte("new"), http.Header{})
+	if err := s.Delete("locked.sql.gz"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Delete with a locked older version returned %v, want ErrLocked", err)
+	}
+	if versions := fake.objects["locked.sql.gz"]; len(versions) != 2 {
+		t.Errorf("%d versions left after a refused Delete, want 2", len(versions))
+	}
+}
+
+func TestS3BucketDefaultRetention(t *testing.T) {
+	fake := newFakeS3(t)
+	fake.versioning = true
+	fake.defaultRetention = time.Hour
+	s := fake.startHTTP(t, S3Options{ObjectLockMode: "GOVERNANCE", ObjectLockPeriod: time.Hour})
+
+	if err := s.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store to a bucket with default retention: %v", err)
+	}
+
+	plain := fake.provider(t, S3Options{Endpoint: s.client.Endpoint, DisableSSL: true})
+	if err := plain.Delete("app.sql.gz"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Delete under a bucket default retention returned %v, want ErrLocked", err)
+	}
+	if fake.latest("app.sql.gz") == nil {
+		t.Error("a locked object was hidden behind a delete marker")
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPOptions configures an SFTP provider.
+type SFTPOptions struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	// PrivateKey is the path of a private key file; PrivateKeyPassphrase
+	// decrypts it if it is encrypted.
+	PrivateKey           string
+	PrivateKeyPassphrase string
+	// KnownHosts is the known_hosts file the server's host key must be
+	// listed in; it defaults to ~/.ssh/known_hosts.
+	KnownHosts string
+	// Path is the remote directory backups are stored under.
+	Path string
+}
+
+// SFTP stores backups on a server reachable over SSH. The connection is
+// opened on first use and re-established after it is lost.
+type SFTP struct {
+	address  string
+	config   *ssh.ClientConfig
+	basePath string
+
+	mu     sync.Mutex
+	ssh    *ssh.Client
+	client *sftp.Client
+}
+
+// NewSFTP checks the credentials and host key file; it does not connect.
+func NewSFTP(options SFTPOptions) (*SFTP, error) {
+	var auth []ssh.AuthMethod
+	if options.PrivateKey != "" {
+		keyData, err := os.ReadFile(options.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		var signer ssh.Signer
+		if options.PrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(keyData, []byte(options.PrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(keyData)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key %s: %w", options.PrivateKey, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if options.Password != "" {
+		auth = append(auth, ssh.Password(options.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp needs a password or a private key")
+	}
+
+	knownHostsFile := options.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+
+	return &SFTP{
+		address: net.JoinHostPort(options.Host, strconv.Itoa(options.Port)),
+		config: &ssh.ClientConfig{
+			User:            options.User,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+		basePath: path.Clean(options.Path),
+	}, nil
+}
+
+// connect returns the SFTP session, dialing if there is none.
+func (s *SFTP) connect() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", s.address, s.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.address, err)
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start sftp session on %s: %w", s.address, err)
+	}
+	s.ssh = sshClient
+	s.client = client
+	return client, nil
+}
+
+// check drops the session after a connection failure so the next call
+// reconnects, and returns err unchanged.
+func (s *SFTP) check(client *sftp.Client, err error) error {
+	if err == nil || !(errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF)) {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == client {
+		s.client.Close()
+		s.ssh.Close()
+		s.client = nil
+		s.ssh = nil
+	}
+	return err
+}
+
+// Close ends the SSH connection, if one is open. A later call connects
+// again.
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	s.client.Close()
+	err := s.ssh.Close()
+	s.client = nil
+	s.ssh = nil
+	return err
+}
+
+func (s *SFTP) remotePath(filename string) string {
+	return path.Join(s.basePath, filename)
+}
+
+// Store uploads to a temporary name and renames it into place, so an
+// interrupted upload never leaves a truncated backup under the real name.
+func (s *SFTP) Store(filename string, data io.Reader) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	target := s.remotePath(filename)
+	if err := client.MkdirAll(path.Dir(target)); err != nil {
+		return s.check(client, err)
+	}
+
+	tmp := tempName(target)
+	file, err := client.Create(tmp)
+	if err != nil {
+		return s.check(client, err)
+	}
+	if _, err := io.Copy(file, data); err != nil {
+		file.Close()
+		client.Remove(tmp)
+		return s.check(client, err)
+	}
+	if err := file.Close(); err != nil {
+		client.Remove(tmp)
+		return s.check(client, err)
+	}
+
+	if err := replace(client, tmp, target); err != nil {
+		client.Remove(tmp)
+		return s.check(client, err)
+	}
+	return nil
+}
+
+// replace moves tmp to target. SFTP version 3 rename fails when the target
+// exists, so the OpenSSH extension is used to replace it atomically. On
+// servers without the extension an existing target is moved aside first
+// and put back if the rename fails.
+func replace(client *sftp.Client, tmp, target string) error {
+	err := client.PosixRename(tmp, target)
+	var status *sftp.StatusError
+	if !errors.As(err, &status) || status.FxCode() != sftp.ErrSSHFxOpUnsupported {
+		return err
+	}
+
+	if _, err := client.Lstat(target); errors.Is(err, fs.ErrNotExist) {
+		return client.Rename(tmp, target)
+	} else if err != nil {
+		return err
+	}
+	old := strings.TrimSuffix(tmp, ".tmp") + ".old.tmp"
+	if err := client.Rename(target, old); err != nil {
+		return err
+	}
+	if err := client.Rename(tmp, target); err != nil {
+		client.Rename(old, target)
+		return err
+	}
+	client.Remove(old)
+	return nil
+}
+
+func (s *SFTP) Open(filename string) (io.ReadCloser, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := client.Open(s.remotePath(filename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, s.check(client, err)
+	}
+	return file, nil
+}
+
+func (s *SFTP) List(prefix string) ([]Object, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []Object
+	walker := client.Walk(s.basePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) && walker.Path() == s.basePath {
+				return nil, nil
+			}
+			return nil, s.check(client, err)
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			continue
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.basePath), "/")
+		if !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		objects = append(objects, Object{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return objects, nil
+}
+
+func (s *SFTP) Delete(filename string) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	err = client.Remove(s.remotePath(filename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return s.check(client, err)
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpTestServer is an SSH server on a loopback port serving the SFTP
+// subsystem from the local file system.
+type sftpTestServer struct {
+	host    string
+	port    int
+	hostKey ssh.Signer
+}
+
+func newSFTPTestServer(t *testing.T) *sftpTestServer {
+	t.Helper()
+
+	hostKey := newTestSigner(t)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("access denied")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	return &sftpTestServer{host: "127.0.0.1", port: address.Port, hostKey: hostKey}
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for request := range requests {
+				ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// knownHosts writes a known_hosts file listing key for the server.
+func (s *sftpTestServer) knownHosts(t *testing.T, key ssh.PublicKey) string {
+	t.Helper()
+	address := knownhosts.Normalize(net.JoinHostPort(s.host, strconv.Itoa(s.port)))
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(file, []byte(knownhosts.Line([]string{address}, key)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (s *sftpTestServer) provider(t *testing.T, knownHosts string) (*SFTP, string) {
+	t.Helper()
+	dir := t.TempDir()
+	provider, err := NewSFTP(SFTPOptions{
+		Host:       s.host,
+		Port:       s.port,
+		User:       "backup",
+		Password:   "secret",
+		KnownHosts: knownHosts,
+		Path:       dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider, dir
+}
+
+func readObject(t *testing.T, provider Provider, name string) string {
+	t.Helper()
+	reader, err := provider.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", name, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSFTPStoreOpenListDelete(t *testing.T) {
+	server := newSFTPTestServer(t)
+	provider, dir := server.provider(t, server.knownHosts(t, server.hostKey.PublicKey()))
+
+	if err := provider.Store("main/app_2024-01-02_03-04-05.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := provider.Store("main/wal/000000010000000000000001.gz", strings.NewReader("wal")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := provider.Store("other.sql.gz", strings.NewReader("other")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	if got := readObject(t, provider, "main/app_2024-01-02_03-04-05.sql.gz"); got != "dump" {
+		t.Errorf("Open returned %q, want %q", got, "dump")
+	}
+
+	// Storing again replaces the object.
+	if err := provider.Store("main/app_2024-01-02_03-04-05.sql.gz", strings.NewReader("dump 2")); err != nil {
+		t.Fatalf("Store over an existing object: %v", err)
+	}
+	if got := readObject(t, provider, "main/app_2024-01-02_03-04-05.sql.gz"); got != "dump 2" {
+		t.Errorf("Open after overwrite returned %q, want %q", got, "dump 2")
+	}
+
+	objects, err := provider.List("main/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	want := []string{"main/app_2024-01-02_03-04-05.sql.gz", "main/wal/000000010000000000000001.gz"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("List returned %v, want %v", names, want)
+	}
+	if objects[0].Size != int64(len("dump 2")) {
+		t.Errorf("List size = %d, want %d", objects[0].Size, len("dump 2"))
+	}
+
+	if err := provider.Delete("main/app_2024-01-02_03-04-05.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := provider.Delete("main/app_2024-01-02_03-04-05.sql.gz"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "main/app_2024-01-02_03-04-05.sql.gz")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("object still exists after Delete: %v", err)
+	}
+}
+
+func TestSFTPOpenMissing(t *testing.T) {
+	server := newSFTPTestServer(t)
+	provider, _ := server.provider(t, server.knownHosts(t, server.hostKey.PublicKey()))
+
+	if _, err := provider.Open("missing.sql.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open of a missing object returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestSFTPList(t *testing.T) {
+	server := newSFTPTestServer(t)
+
+	t.Run("missing directory", func(t *testing.T) {
+		provider, dir := server.provider(t, server.knownHosts(t, server.hostKey.PublicKey()))
+		provider.basePath = filepath.Join(dir, "missing")
+		objects, err := provider.List("")
+		if err != nil || len(objects) != 0 {
+			t.Errorf("List of a missing directory returned %v, %v", objects, err)
+		}
+	})
+
+	t.Run("partial uploads", func(t *testing.T) {
+		provider, dir := server.provider(t, server.knownHosts(t, server.hostKey.PublicKey()))
+		if err := os.WriteFile(filepath.Join(dir, "app.sql.gz.0123456789abcdef.tmp"), []byte("partial"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		objects, err := provider.List("")
+		if err != nil || len(objects) != 0 {
+			t.Errorf("List returned %v, %v; want partial uploads skipped", objects, err)
+		}
+	})
+}
+
+func TestSFTPConcurrentStores(t *testing.T) {
+	server := newSFTPTestServer(t)
+	provider, dir := server.provider(t, server.knownHosts(t, server.hostKey.PublicKey()))
+
+	contents := make([]string, 8)
+	for i := range contents {
+		contents[i] = strings.Repeat(strconv.Itoa(i), 64<<10)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(contents))
+	for i, content := range contents {
+		wg.Add(1)
+		go func(i int, content string) {
+			defer wg.Done()
+			errs[i] = provider.Store("app.sql.gz", strings.NewReader(content))
+		}(i, content)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Store %d: %v", i, err)
+		}
+	}
+
+	got := readObject(t, provider, "app.sql.gz")
+	found := false
+	for _, content := range contents {
+		found = found || got == content
+	}
+	if !found {
+		t.Errorf("object holds a mix of concurrent uploads (%d bytes)", len(got))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries after concurrent stores, want 1", len(entries))
+	}
+}
+
+func TestSFTPRejectsUnknownHostKey(t *testing.T) {
+	server := newSFTPTestServer(t)
+	provider, _ := server.provider(t, server.knownHosts(t, newTestSigner(t).PublicKey()))
+
+	err := provider.Store("app.sql.gz", bytes.NewReader([]byte("dump")))
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		t.Fatalf("Store with a mismatching host key returned %v, want a host key mismatch", err)
+	}
+}
+
+func TestSFTPRejectsUnlistedHost(t *testing.T) {
+	server := newSFTPTestServer(t)
+	empty := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, _ := server.provider(t, empty)
+
+	_, err := provider.List("")
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) != 0 {
+		t.Fatalf("List against an unlisted host returned %v, want an unknown host error", err)
+	}
+}
+
+func TestSFTPClose(t *testing.T) {
+	server := newSFTPTestServer(t)
+	provider, _ := server.provider(t, server.knownHosts(t, server.hostKey.PublicKey()))
+
+	if err := provider.Close(); err != nil {
+		t.Errorf("Close before connecting: %v", err)
+	}
+	if err := provider.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	sshClient := provider.ssh
+	if err := Close(provider); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if provider.client != nil {
+		t.Error("Close kept the SFTP session")
+	}
+	if err := sshClient.Wait(); err == nil {
+		t.Error("the SSH connection is still open after Close")
+	}
+
+	// A closed provider connects again when it is used.
+	if got := readObject(t, provider, "app.sql.gz"); got != "dump" {
+		t.Errorf("Open after Close returned %q", got)
+	}
+}
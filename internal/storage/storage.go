@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+type Provider interface {
+	Store(filename string, data io.Reader) error
+	// Open returns the contents of a stored object, or ErrNotFound.
+	Open(filename string) (io.ReadCloser, error)
+	// List returns the objects whose name starts with prefix.
+	List(prefix string) ([]Object, error)
+	Delete(filename string) error
+}
+
+// Object is an entry returned by Provider.List. Name uses forward slashes
+// regardless of the provider.
+type Object struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ErrNotFound is returned by Open when the object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ErrLocked is returned by Delete when the object is protected by a
+// retention lock or legal hold and cannot be deleted yet.
+var ErrLocked = errors.New("object is locked")
+
+// Metadata describes the contents of a stored object, e.g. the server and
+// database of a backup.
+type Metadata map[string]string
+
+// MetadataStore is implemented by providers that can keep metadata with an
+// object.
+type MetadataStore interface {
+	StoreWithMetadata(filename string, data io.Reader, metadata Metadata) error
+}
+
+// StoreWithMetadata stores data with metadata when the provider supports
+// it and without it otherwise.
+func StoreWithMetadata(provider Provider, filename string, data io.Reader, metadata Metadata) error {
+	if store, ok := provider.(MetadataStore); ok {
+		return store.StoreWithMetadata(filename, data, metadata)
+	}
+	return provider.Store(filename, data)
+}
+
+// Close releases the connections provider holds, if it implements
+// io.Closer, as providers with persistent connections do.
+func Close(provider Provider) error {
+	if closer, ok := provider.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// tempName returns a unique name ending in ".tmp" to upload name under
+// before it is moved into place, so concurrent uploads of the same object
+// never write to the same file.
+func tempName(name string) string {
+	var random [8]byte
+	rand.Read(random[:])
+	return name + "." + hex.EncodeToString(random[:]) + ".tmp"
+}
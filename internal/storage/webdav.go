@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebDAVOptions configures a WebDAV provider.
+type WebDAVOptions struct {
+	// URL is the collection backups are stored under, e.g.
+	// https://nas.example.com/remote.php/dav/files/backup/postgres.
+	URL      string
+	User     string
+	Password string
+	// CACert is a PEM file with the certificates the server's certificate
+	// may be signed by, in addition to the system roots.
+	CACert string
+}
+
+// WebDAV stores backups on a WebDAV server such as a NAS. Basic and digest
+// authentication are supported; which one is used follows the server's
+// challenge.
+type WebDAV struct {
+	client   *http.Client
+	baseURL  *url.URL
+	user     string
+	password string
+
+	mu          sync.Mutex
+	digest      *digestChallenge
+	collections map[string]bool
+}
+
+func NewWebDAV(options WebDAVOptions) (*WebDAV, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(options.URL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.CACert != "" {
+		pem, err := os.ReadFile(options.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", options.CACert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &WebDAV{
+		client:      &http.Client{Transport: transport},
+		baseURL:     baseURL,
+		user:        options.User,
+		password:    options.Password,
+		collections: make(map[string]bool),
+	}, nil
+}
+
+// Close closes the idle connections of the provider's own transport.
+func (w *WebDAV) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+func (w *WebDAV) url(name string) string {
+	u := *w.baseURL
+	if name != "" {
+		u.Path += "/" + name
+	}
+	u.RawPath = ""
+	return u.String()
+}
+
+// Store creates the collections above filename, then streams the data to a
+// unique temporary name with chunked transfer encoding and moves it into
+// place, so an interrupted upload never leaves a truncated backup under the
+// real name and concurrent uploads do not write to the same file. The whole
+// backup is sent in one request; Nextcloud's chunked upload API is not
+// used.
+func (w *WebDAV) Store(filename string, data io.Reader) error {
+	if err := w.makeCollections(path.Dir(filename)); err != nil {
+		return err
+	}
+
+	// The body cannot be replayed, so the server is asked to accept the
+	// request before it is sent. A stale digest nonce is then rejected
+	// before any data is read and the upload can be repeated.
+	tmp := tempName(filename)
+	body := &startedReader{reader: data}
+	headers := http.Header{"Expect": {"100-continue"}}
+	resp, err := w.do(http.MethodPut, w.url(tmp), headers, body)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && !body.started && w.learnChallenge(resp) {
+		resp.Body.Close()
+		resp, err = w.do(http.MethodPut, w.url(tmp), headers, body)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		w.Delete(tmp)
+		return w.statusError(http.MethodPut, tmp, resp)
+	}
+
+	headers = http.Header{"Destination": {w.url(filename)}, "Overwrite": {"T"}}
+	resp, err = w.send("MOVE", w.url(tmp), headers, nil)
+	if err != nil {
+		w.Delete(tmp)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		w.Delete(tmp)
+		return w.statusError("MOVE", tmp, resp)
+	}
+	return nil
+}
+
+// startedReader records whether any of a request body has been read, after
+// which the request cannot be repeated.
+type startedReader struct {
+	reader  io.Reader
+	started bool
+}
+
+func (r *startedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.started = true
+	}
+	return n, err
+}
+
+// makeCollections creates the collection dir and every collection above it
+// that has not been seen yet. An existing collection answers MKCOL with
+// 405 Method Not Allowed.
+func (w *WebDAV) makeCollections(dir string) error {
+	var parts []string
+	if dir != "." && dir != "/" {
+		parts = strings.Split(strings.Trim(dir, "/"), "/")
+	}
+
+	for i := 0; i <= len(parts); i++ {
+		collection := strings.Join(parts[:i], "/")
+		w.mu.Lock()
+		known := w.collections[collection]
+		w.mu.Unlock()
+		if known {
+			continue
+		}
+
+		resp, err := w.send("MKCOL", w.url(collection), nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 && resp.StatusCode != http.StatusMethodNotAllowed {
+			return w.statusError("MKCOL", collection, resp)
+		}
+
+		w.mu.Lock()
+		w.collections[collection] = true
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+func (w *WebDAV) Open(filename string) (io.ReadCloser, error) {
+	resp, err := w.send(http.MethodGet, w.url(filename), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, w.statusError(http.MethodGet, filename, resp)
+	}
+	return resp.Body, nil
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// List walks the collections one level at a time, as many servers refuse
+// PROPFIND with infinite depth. Only collections that can contain names
+// starting with prefix are descended into.
+func (w *WebDAV) List(prefix string) ([]Object, error) {
+	var objects []Object
+	pending := []string{""}
+	for len(pending) > 0 {
+		collection := pending[0]
+		pending = pending[1:]
+
+		entries, err := w.propfind(collection)
+		if errors.Is(err, ErrNotFound) && collection == "" {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.Name == collection {
+				continue
+			}
+			if entry.collection {
+				dir := entry.Name + "/"
+				if strings.HasPrefix(dir, prefix) || strings.HasPrefix(prefix, dir) {
+					pending = append(pending, entry.Name)
+				}
+				continue
+			}
+			if !strings.HasPrefix(entry.Name, prefix) || strings.HasSuffix(entry.Name, ".tmp") {
+				continue
+			}
+			objects = append(objects, entry.Object)
+		}
+	}
+	return objects, nil
+}
+
+type davEntry struct {
+	Object
+	collection bool
+}
+
+// propfind lists the members of a collection, named relative to the base
+// URL.
+func (w *WebDAV) propfind(collection string) ([]davEntry, error) {
+	headers := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	target := w.url(collection)
+	if collection != "" {
+		target += "/"
+	}
+	resp, err := w.send("PROPFIND", target, headers, []byte(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, w.statusError("PROPFIND", collection, resp)
+	}
+
+	var result multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse PROPFIND response: %w", err)
+	}
+
+	basePath := strings.TrimSuffix(w.baseURL.Path, "/")
+	var entries []davEntry
+	for _, response := range result.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			continue
+		}
+		name := strings.Trim(strings.TrimPrefix(strings.TrimSuffix(href.Path, "/"), basePath), "/")
+
+		entry := davEntry{Object: Object{Name: name}}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			entry.collection = propstat.Prop.ResourceType.Collection != nil
+			entry.Size = propstat.Prop.ContentLength
+			entry.ModTime, _ = time.Parse(http.TimeFormat, propstat.Prop.LastModified)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (w *WebDAV) Delete(filename string) error {
+	resp, err := w.send(http.MethodDelete, w.url(filename), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return w.statusError(http.MethodDelete, filename, resp)
+	}
+	return nil
+}
+
+func (w *WebDAV) statusError(method, name string, resp *http.Response) error {
+	return fmt.Errorf("webdav %s %s: %s", method, w.url(name), resp.Status)
+}
+
+// send sends a request with a body that can be replayed, repeating it once
+// when the server answers with a new digest challenge.
+func (w *WebDAV) send(method, target string, headers http.Header, body []byte) (*http.Response, error) {
+	resp, err := w.do(method, target, headers, bytes.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !w.learnChallenge(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+	return w.do(method, target, headers, bytes.NewReader(body))
+}
+
+// do sends a request once. A body that is not a bytes.Reader is streamed
+// with chunked transfer encoding.
+func (w *WebDAV) do(method, target string, headers http.Header, body io.Reader) (*http.Response, error) {
+	if reader, ok := body.(*bytes.Reader); ok && reader.Len() == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if err := w.authorize(req); err != nil {
+		return nil, err
+	}
+	return w.client.Do(req)
+}
+
+func (w *WebDAV) authorize(req *http.Request) error {
+	if w.user == "" {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.digest == nil {
+		req.SetBasicAuth(w.user, w.password)
+		return nil
+	}
+	authorization, err := w.digest.authorize(req.Method, req.URL.RequestURI(), w.user, w.password)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	return nil
+}
+
+// learnChallenge records the digest challenge of a 401 response and reports
+// whether the request is worth repeating with it.
+func (w *WebDAV) learnChallenge(resp *http.Response) bool {
+	if w.user == "" {
+		return false
+	}
+	for _, header := range resp.Header.Values("Www-Authenticate") {
+		challenge, ok := parseDigestChallenge(header)
+		if !ok {
+			continue
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		// A repeated challenge for the same nonce means the credentials
+		// are wrong, unless the server marks the nonce as stale.
+		if w.digest != nil && w.digest.nonce == challenge.nonce && !challenge.stale {
+			return false
+		}
+		w.digest = challenge
+		return true
+	}
+	return false
+}
+
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       bool
+	stale     bool
+	count     int
+}
+
+func parseDigestChallenge(header string) (*digestChallenge, bool) {
+	scheme, params, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Digest") {
+		return nil, false
+	}
+
+	values := make(map[string]string)
+	for params != "" {
+		var key, value string
+		key, params, _ = strings.Cut(strings.TrimLeft(params, " ,"), "=")
+		if strings.HasPrefix(params, `"`) {
+			end := strings.Index(params[1:], `"`)
+			if end < 0 {
+				return nil, false
+			}
+			value, params = params[1:end+1], params[end+2:]
+		} else {
+			value, params, _ = strings.Cut(params, ",")
+		}
+		values[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+
+	challenge := &digestChallenge{
+		realm:     values["realm"],
+		nonce:     values["nonce"],
+		opaque:    values["opaque"],
+		algorithm: values["algorithm"],
+		stale:     strings.EqualFold(values["stale"], "true"),
+	}
+	for _, qop := range strings.Split(values["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			challenge.qop = true
+		}
+	}
+	switch strings.ToUpper(challenge.algorithm) {
+	case "", "MD5", "SHA-256":
+	default:
+		return nil, false
+	}
+	return challenge, challenge.nonce != ""
+}
+
+// authorize computes the Authorization header for a request (RFC 7616).
+// It must be called with the provider's lock held.
+func (c *digestChallenge) authorize(method, uri, user, password string) (string, error) {
+	var newHash func() hash.Hash = md5.New
+	if strings.EqualFold(c.algorithm, "SHA-256") {
+		newHash = sha256.New
+	}
+	digest := func(parts ...string) string {
+		h := newHash()
+		io.WriteString(h, strings.Join(parts, ":"))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	ha1 := digest(user, c.realm, password)
+	ha2 := digest(method, uri)
+	fields := []string{
+		fmt.Sprintf("username=%q", user),
+		fmt.Sprintf("realm=%q", c.realm),
+		fmt.Sprintf("nonce=%q", c.nonce),
+		fmt.Sprintf("uri=%q", uri),
+	}
+	if c.qop {
+		c.count++
+		nonce := make([]byte, 8)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		cnonce := hex.EncodeToString(nonce)
+		nc := fmt.Sprintf("%08x", c.count)
+		fields = append(fields,
+			"qop=auth",
+			"nc="+nc,
+			fmt.Sprintf("cnonce=%q", cnonce),
+			fmt.Sprintf("response=%q", digest(ha1, c.nonce, nc, cnonce, "auth", ha2)))
+	} else {
+		fields = append(fields, fmt.Sprintf("response=%q", digest(ha1, c.nonce, ha2)))
+	}
+	if c.opaque != "" {
+		fields = append(fields, fmt.Sprintf("opaque=%q", c.opaque))
+	}
+	if c.algorithm != "" {
+		fields = append(fields, "algorithm="+c.algorithm)
+	}
+	return "Digest " + strings.Join(fields, ", "), nil
+}
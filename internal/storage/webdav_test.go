@@ -0,0 +1,460 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webdavTestBase is the path of the collection the provider stores under,
+// like a Nextcloud user's files.
+const webdavTestBase = "/remote.php/dav/files/backup"
+
+// fakeWebDAV is a minimal WebDAV server. Like most NAS and Nextcloud
+// servers it refuses infinite-depth PROPFIND, answers MKCOL with 409 when
+// the parent collection is missing, and only replaces an existing file on
+// MOVE with "Overwrite: T".
+type fakeWebDAV struct {
+	t        *testing.T
+	server   *httptest.Server
+	user     string
+	password string
+	// digest requires digest authentication instead of basic.
+	digest bool
+
+	mu          sync.Mutex
+	nonce       string
+	nonces      int
+	files       map[string][]byte
+	collections map[string]bool
+	requests    []webdavTestRequest
+	// staleOnPut answers the next PUT with a new, stale-marked nonce
+	// without reading its body.
+	staleOnPut bool
+	// failPut and failMove make uploads or moves fail after the request
+	// was read.
+	failPut  bool
+	failMove bool
+}
+
+type webdavTestRequest struct {
+	method string
+	name   string
+	header http.Header
+}
+
+func newFakeWebDAV(t *testing.T) *fakeWebDAV {
+	f := &fakeWebDAV{
+		t:           t,
+		user:        "backup",
+		password:    "secret",
+		files:       make(map[string][]byte),
+		collections: map[string]bool{"": true},
+	}
+	f.newNonce()
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeWebDAV) provider(t *testing.T) *WebDAV {
+	w, err := NewWebDAV(WebDAVOptions{URL: f.server.URL + webdavTestBase + "/", User: f.user, Password: f.password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func (f *fakeWebDAV) newNonce() {
+	f.nonces++
+	f.nonce = fmt.Sprintf("nonce-%d", f.nonces)
+}
+
+// methods returns the method and name of every request with one of the
+// given methods, in order.
+func (f *fakeWebDAV) methods(methods ...string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var got []string
+	for _, request := range f.requests {
+		for _, method := range methods {
+			if request.method == method {
+				got = append(got, request.method+" "+request.name)
+			}
+		}
+	}
+	return got
+}
+
+var digestParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// authorized checks the request's credentials and sends a challenge when
+// they are missing or wrong.
+func (f *fakeWebDAV) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if !f.digest {
+		if user, password, ok := r.BasicAuth(); ok && user == f.user && password == f.password {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="webdav"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	params := make(map[string]string)
+	if scheme, rest, _ := strings.Cut(r.Header.Get("Authorization"), " "); scheme == "Digest" {
+		for _, match := range digestParam.FindAllStringSubmatch(rest, -1) {
+			params[match[1]] = match[2] + match[3]
+		}
+	}
+	digest := func(parts ...string) string {
+		sum := md5.Sum([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum[:])
+	}
+	ha1 := digest(f.user, "webdav", f.password)
+	ha2 := digest(r.Method, r.URL.RequestURI())
+	want := digest(ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2)
+	stale := params["nonce"] != "" && params["nonce"] != f.nonce
+	if params["username"] == f.user && params["uri"] == r.URL.RequestURI() && !stale && params["response"] == want {
+		return true
+	}
+	challenge := fmt.Sprintf(`Digest realm="webdav", nonce="%s", qop="auth", algorithm=MD5`, f.nonce)
+	if stale {
+		challenge += ", stale=true"
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+// name returns the path of target relative to the base collection.
+func (f *fakeWebDAV) name(target string) (string, bool) {
+	name, ok := strings.CutPrefix(target, webdavTestBase)
+	if !ok || name != "" && !strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	return strings.Trim(name, "/"), true
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name, ok := f.name(r.URL.Path)
+	f.requests = append(f.requests, webdavTestRequest{method: r.Method, name: name, header: r.Header.Clone()})
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPut && f.staleOnPut {
+		f.staleOnPut = false
+		f.newNonce()
+	}
+	if !f.authorized(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "MKCOL":
+		switch {
+		case f.collections[name] || f.files[name] != nil:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !f.collections[parentCollection(name)]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			f.collections[name] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodPut:
+		if !f.collections[parentCollection(name)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.files[name] = body
+		if f.failPut {
+			// A server that ran out of space may leave what it received.
+			w.WriteHeader(http.StatusInsufficientStorage)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		data, ok := f.files[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		if _, ok := f.files[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, name)
+		w.WriteHeader(http.StatusNoContent)
+	case "MOVE":
+		f.move(w, r, name)
+	case "PROPFIND":
+		f.propfind(w, r, name)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func parentCollection(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+func (f *fakeWebDAV) move(w http.ResponseWriter, r *http.Request, name string) {
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	target, ok := f.name(destination.Path)
+	data, exists := f.files[name]
+	switch {
+	case !ok:
+		w.WriteHeader(http.StatusBadGateway)
+	case !exists:
+		w.WriteHeader(http.StatusNotFound)
+	case f.failMove:
+		w.WriteHeader(http.StatusInternalServerError)
+	case f.files[target] != nil && r.Header.Get("Overwrite") != "T":
+		w.WriteHeader(http.StatusPreconditionFailed)
+	default:
+		status := http.StatusCreated
+		if f.files[target] != nil {
+			status = http.StatusNoContent
+		}
+		f.files[target] = data
+		delete(f.files, name)
+		w.WriteHeader(status)
+	}
+}
+
+// propfind lists a collection and its members with percent-encoded hrefs.
+func (f *fakeWebDAV) propfind(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Header.Get("Depth") != "1" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !f.collections[name] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	href := func(member string, collection bool) string {
+		p := webdavTestBase
+		if member != "" {
+			p += "/" + member
+		}
+		if collection {
+			p += "/"
+		}
+		return (&url.URL{Path: p}).EscapedPath()
+	}
+	var response bytes.Buffer
+	response.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:multistatus xmlns:d="DAV:">`)
+	entry := func(member string, collection bool, size int) {
+		resourceType := ""
+		if collection {
+			resourceType = "<d:collection/>"
+		}
+		fmt.Fprintf(&response, `<d:response><d:href>%s</d:href><d:propstat><d:prop><d:resourcetype>%s</d:resourcetype><d:getcontentlength>%d</d:getcontentlength><d:getlastmodified>Mon, 01 Jan 2024 00:00:00 GMT</d:getlastmodified></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response>`,
+			href(member, collection), resourceType, size)
+	}
+	entry(name, true, 0)
+	var members []string
+	for collection := range f.collections {
+		if collection != "" && parentCollection(collection) == name {
+			members = append(members, collection)
+		}
+	}
+	for file := range f.files {
+		if parentCollection(file) == name {
+			members = append(members, file)
+		}
+	}
+	sort.Strings(members)
+	for _, member := range members {
+		entry(member, f.collections[member], len(f.files[member]))
+	}
+	response.WriteString(`</d:multistatus>`)
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(response.Bytes())
+}
+
+func TestWebDAVStoreOpenListDelete(t *testing.T) {
+	fake := newFakeWebDAV(t)
+	w := fake.provider(t)
+
+	if err := w.Store("main/app db/app_2024.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	want := []string{"MKCOL ", "MKCOL main", "MKCOL main/app db"}
+	if got := fake.methods("MKCOL"); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("created collections %q, want %q", got, want)
+	}
+	moves := fake.methods("MOVE")
+	if len(moves) != 1 || !strings.HasPrefix(moves[0], "MOVE main/app db/app_2024.sql.gz.") || !strings.HasSuffix(moves[0], ".tmp") {
+		t.Errorf("moves %q, want one from a temporary name", moves)
+	}
+
+	// Storing again replaces the object, which needs Overwrite: T.
+	if err := w.Store("main/app db/app_2024.sql.gz", strings.NewReader("newer dump")); err != nil {
+		t.Fatalf("Store over an existing object: %v", err)
+	}
+	for _, request := range fake.requests {
+		if request.method == "MOVE" && request.header.Get("Overwrite") != "T" {
+			t.Errorf("MOVE sent Overwrite %q, want T", request.header.Get("Overwrite"))
+		}
+	}
+	if got := len(fake.methods("MKCOL")); got != 3 {
+		t.Errorf("sent %d MKCOL requests, want the collections created only once", got)
+	}
+
+	reader, err := w.Open("main/app db/app_2024.sql.gz")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(data) != "newer dump" {
+		t.Errorf("Open returned %q", data)
+	}
+
+	if err := w.Store("other/app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := w.List("main/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Name != "main/app db/app_2024.sql.gz" || objects[0].Size != 10 {
+		t.Errorf("List returned %+v", objects)
+	}
+	for _, request := range fake.requests {
+		if request.method == "PROPFIND" && request.name == "other" {
+			t.Error("List descended into a collection outside the prefix")
+		}
+	}
+
+	if err := w.Delete("main/app db/app_2024.sql.gz"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := w.Open("main/app db/app_2024.sql.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open after Delete returned %v, want ErrNotFound", err)
+	}
+	if err := w.Delete("main/app db/app_2024.sql.gz"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+}
+
+func TestWebDAVListRecursion(t *testing.T) {
+	fake := newFakeWebDAV(t)
+	w := fake.provider(t)
+
+	names := []string{"app_1.sql.gz", "main/app_2.sql.gz", "main/wal/0000000100000000000000A1.gz", "main/my db/dump #1.sql.gz"}
+	for _, name := range names {
+		if err := w.Store(name, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.files["main/leftover.sql.gz.1234.tmp"] = []byte("partial")
+
+	objects, err := w.List("")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var got []string
+	for _, object := range objects {
+		got = append(got, object.Name)
+	}
+	sort.Strings(got)
+	sort.Strings(names)
+	if strings.Join(got, ",") != strings.Join(names, ",") {
+		t.Errorf("List returned %q, want %q", got, names)
+	}
+}
+
+func TestWebDAVDigest(t *testing.T) {
+	fake := newFakeWebDAV(t)
+	fake.digest = true
+	w := fake.provider(t)
+
+	if _, err := w.List(""); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	propfinds := fake.requests
+	if len(propfinds) != 2 || propfinds[0].header.Get("Authorization") == propfinds[1].header.Get("Authorization") ||
+		!strings.HasPrefix(propfinds[1].header.Get("Authorization"), "Digest ") {
+		t.Errorf("want a basic request answered with a challenge and a digest retry, got %d requests", len(propfinds))
+	}
+
+	// A nonce that goes stale before an upload is renewed before the body
+	// is sent, so the upload can be repeated.
+	fake.staleOnPut = true
+	if err := w.Store("app.sql.gz", strings.NewReader("dump")); err != nil {
+		t.Fatalf("Store with a stale nonce: %v", err)
+	}
+	if string(fake.files["app.sql.gz"]) != "dump" {
+		t.Errorf("stored %q, want dump", fake.files["app.sql.gz"])
+	}
+	if got := len(fake.methods(http.MethodPut)); got != 2 {
+		t.Errorf("sent %d PUT requests, want 2", got)
+	}
+
+	wrong := fake.provider(t)
+	wrong.password = "wrong"
+	if _, err := wrong.List(""); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("List with a wrong password returned %v, want 401", err)
+	}
+}
+
+func TestWebDAVUploadCleanup(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(f *fakeWebDAV)
+	}{
+		{"failed upload", func(f *fakeWebDAV) { f.failPut = true }},
+		{"failed move", func(f *fakeWebDAV) { f.failMove = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeWebDAV(t)
+			tt.setup(fake)
+			w := fake.provider(t)
+
+			if err := w.Store("main/app.sql.gz", strings.NewReader("dump")); err == nil {
+				t.Fatal("Store succeeded")
+			}
+			for name := range fake.files {
+				t.Errorf("%s left behind", name)
+			}
+			deletes := fake.methods(http.MethodDelete)
+			if len(deletes) != 1 || !strings.HasSuffix(deletes[0], ".tmp") {
+				t.Errorf("deleted %q, want the temporary file", deletes)
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"pg-backup/internal/backup"
@@ -12,8 +15,6 @@ import (
 	"pg-backup/internal/health"
 	"pg-backup/internal/logger"
 	"pg-backup/internal/storage"
-
-	"github.com/robfig/cron/v3"
 )
 
 func main() {
@@ -21,18 +22,26 @@ func main() {
 		configFile = flag.String("config", "config.yaml", "Configuration file path")
 		runOnce    = flag.Bool("once", false, "Run backup once and exit")
 		listDbs    = flag.Bool("list", false, "List configured databases and exit")
+		checkCfg   = flag.Bool("check-config", false, "Validate the configuration file and exit")
+		serverName = flag.String("server", "", "Server to use for commands when several are configured")
 	)
+	flag.Usage = usage
 	flag.Parse()
 
+	if *checkCfg {
+		os.Exit(checkConfig(*configFile))
+	}
+
 	cfg, err := config.Load(*configFile)
 	if err != nil {
 		log.Fatal("Failed to load config:", err)
 	}
 
 	if *listDbs {
-		fmt.Println("Configured databases:")
-		for i, db := range cfg.Database.Databases {
-			fmt.Printf("  %d. %s\n", i+1, db)
+		// Listing is read-only, so it logs to stderr rather than creating
+		// the log file.
+		if err := listDatabases(cfg, backup.NewService(cfg, nil, logger.NewStderr())); err != nil {
+			os.Exit(1)
 		}
 		return
 	}
@@ -40,25 +49,23 @@ func main() {
 	appLogger := logger.New(cfg.LogFile)
 	defer appLogger.Close()
 
-	var storageProvider storage.Provider
-	switch cfg.Storage.Type {
-	case "local":
-		storageProvider = storage.NewLocal(cfg.Storage.Local.Path)
-	case "s3":
-		s3Provider, err := storage.NewS3(cfg.Storage.S3.Bucket, cfg.Storage.S3.Region, cfg.Storage.S3.Endpoint, cfg.Storage.S3.AccessKey, cfg.Storage.S3.SecretKey)
-		if err != nil {
-			appLogger.Error("Failed to initialize S3 storage: %v", err)
-			os.Exit(1)
-		}
-		storageProvider = s3Provider
-	default:
-		appLogger.Error("Invalid storage type: %s", cfg.Storage.Type)
+	storageProvider, err := newStorageProvider(cfg)
+	if err != nil {
+		appLogger.Error("Failed to initialize storage: %v", err)
 		os.Exit(1)
 	}
 
 	backupService := backup.NewService(cfg, storageProvider, appLogger)
-	healthService := health.NewService(appLogger, len(cfg.Database.Databases))
+
+	if flag.NArg() > 0 {
+		code := runCommand(backupService, appLogger, *configFile, *serverName, flag.Args())
+		appLogger.Close()
+		os.Exit(code)
+	}
+
+	healthService := health.NewService(appLogger, configuredDatabaseCount(cfg))
 	healthService.SetBackupService(backupService)
+	backupService.SetObserver(healthService)
 
 	go healthService.Start(cfg.HealthCheckPort)
 
@@ -73,45 +80,207 @@ func main() {
 		return
 	}
 
-	runScheduler(cfg, backupService, appLogger, healthService)
+	newScheduler(*configFile, cfg, backupService, healthService, appLogger).run()
 }
 
-func runScheduler(cfg *config.Config, backupService *backup.Service, appLogger *logger.Logger, healthService *health.Service) {
-	appLogger.Info("Starting pg-backup scheduler")
-
-	c := cron.New()
-
-	_, err := c.AddFunc(cfg.Schedule, func() {
-		appLogger.Info("Starting scheduled backup")
-		start := time.Now()
-		dbCount, err := backupService.BackupAll()
+// newStorageProvider returns a provider writing to every configured
+// destination.
+func newStorageProvider(cfg *config.Config) (storage.Provider, error) {
+	var targets []storage.Target
+	for _, destination := range cfg.DestinationList() {
+		provider, err := newDestinationProvider(destination)
 		if err != nil {
-			appLogger.Error("Backup failed: %v", err)
-		} else {
-			appLogger.Info("Backup completed successfully for %d databases", dbCount)
-			healthService.UpdateBackupStats(time.Now(), start.Add(24*time.Hour), 1, dbCount)
+			if len(cfg.Destinations) > 0 {
+				return nil, fmt.Errorf("destination %s: %w", destination.Name, err)
+			}
+			return nil, err
 		}
-	})
+		targets = append(targets, storage.Target{Name: destination.Name, Provider: provider})
+	}
+	return storage.NewMulti(targets, cfg.DestinationPolicy == config.DestinationPolicyAll), nil
+}
 
-	if err != nil {
-		appLogger.Error("Failed to schedule backup: %v", err)
-		return
+func newDestinationProvider(destination config.Destination) (storage.Provider, error) {
+	switch destination.Type {
+	case "local":
+		options := destination.Local
+		fileMode, err := config.ParseFileMode(options.FileMode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize local storage: %w", err)
+		}
+		dirMode, err := config.ParseFileMode(options.DirMode)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize local storage: %w", err)
+		}
+		minFreeSpace, err := config.ParseSize(options.MinFreeSpace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize local storage: %w", err)
+		}
+		return storage.NewLocal(storage.LocalOptions{
+			Path:         options.Path,
+			FileMode:     fileMode,
+			DirMode:      dirMode,
+			MinFreeSpace: minFreeSpace,
+		}), nil
+	case "s3":
+		options := destination.S3
+		s3Options := storage.S3Options{
+			Bucket:              options.Bucket,
+			Region:              options.Region,
+			Endpoint:            options.Endpoint,
+			AccessKey:           options.AccessKey,
+			SecretKey:           options.SecretKey,
+			ForcePathStyle:      options.ForcePathStyle,
+			DisableSSL:          options.DisableSSL,
+			CACert:              options.CACert,
+			StorageClass:        options.StorageClass,
+			Tags:                options.Tags,
+			ACL:                 options.ACL,
+			ExpectedBucketOwner: options.ExpectedBucketOwner,
+		}
+		if options.ObjectLock.Mode != "" {
+			s3Options.ObjectLockMode = strings.ToUpper(options.ObjectLock.Mode)
+			s3Options.ObjectLockPeriod = time.Duration(destination.ObjectLockDays()) * 24 * time.Hour
+		}
+		s3Options.LegalHold = options.ObjectLock.LegalHold
+		switch options.ServerSideEncryption {
+		case "sse-s3":
+			s3Options.ServerSideEncryption = "AES256"
+		case "sse-kms":
+			s3Options.ServerSideEncryption = "aws:kms"
+			s3Options.KMSKeyID = options.KMSKeyID
+		case "sse-c":
+			key, err := base64.StdEncoding.DecodeString(options.SSECustomerKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid s3 sse_customer_key: %w", err)
+			}
+			s3Options.SSECustomerKey = string(key)
+		}
+		s3Provider, err := storage.NewS3(s3Options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize S3 storage: %w", err)
+		}
+		return s3Provider, nil
+	case "sftp":
+		options := destination.SFTP
+		sftpProvider, err := storage.NewSFTP(storage.SFTPOptions{
+			Host:                 options.Host,
+			Port:                 options.Port,
+			User:                 options.User,
+			Password:             options.Password,
+			PrivateKey:           options.PrivateKey,
+			PrivateKeyPassphrase: options.PrivateKeyPassphrase,
+			KnownHosts:           options.KnownHosts,
+			Path:                 options.Path,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize SFTP storage: %w", err)
+		}
+		return sftpProvider, nil
+	case "azure":
+		options := destination.Azure
+		azureProvider, err := storage.NewAzure(storage.AzureOptions{
+			Account:    options.Account,
+			AccountKey: options.AccountKey,
+			SASToken:   options.SASToken,
+			Container:  options.Container,
+			Prefix:     options.Prefix,
+			Endpoint:   options.Endpoint,
+			AccessTier: options.AccessTier,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize Azure storage: %w", err)
+		}
+		return azureProvider, nil
+	case "gcs":
+		options := destination.GCS
+		gcsProvider, err := storage.NewGCS(storage.GCSOptions{
+			Bucket:          options.Bucket,
+			Prefix:          options.Prefix,
+			CredentialsFile: options.CredentialsFile,
+			StorageClass:    options.StorageClass,
+			Endpoint:        options.Endpoint,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize GCS storage: %w", err)
+		}
+		return gcsProvider, nil
+	case "webdav":
+		options := destination.WebDAV
+		webdavProvider, err := storage.NewWebDAV(storage.WebDAVOptions{
+			URL:      options.URL,
+			User:     options.User,
+			Password: options.Password,
+			CACert:   options.CACert,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize WebDAV storage: %w", err)
+		}
+		return webdavProvider, nil
+	default:
+		return nil, fmt.Errorf("invalid storage type: %s", destination.Type)
 	}
+}
 
-	c.Start()
-	appLogger.Info("Backup scheduler started with cron: %s", cfg.Schedule)
+// listDatabases prints the databases each server's next backup would
+// cover, running discovery for servers without an explicit list.
+func listDatabases(cfg *config.Config, backupService *backup.Service) error {
+	var failed error
+	for _, server := range cfg.ServerList() {
+		if len(cfg.Servers) > 0 {
+			fmt.Printf("Server %s (%s:%d):\n", server.Name, server.Host, server.Port)
+		}
+		if server.FullDump {
+			fmt.Println("Full dump of the entire server (pg_dumpall)")
+			continue
+		}
 
-	if cfg.RunOnStart {
-		appLogger.Info("Running initial backup")
-		start := time.Now()
-		dbCount, err := backupService.BackupAll()
-		if err != nil {
-			appLogger.Error("Initial backup failed: %v", err)
+		if len(server.Databases) > 0 {
+			fmt.Println("Configured databases:")
 		} else {
-			appLogger.Info("Initial backup completed successfully for %d databases", dbCount)
-			healthService.UpdateBackupStats(time.Now(), start.Add(24*time.Hour), 1, dbCount)
+			fmt.Println("Discovered databases:")
+		}
+		databases, err := backupService.Databases(server)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "  failed to discover databases: %v\n", err)
+			failed = err
+			continue
+		}
+		for i, db := range databases {
+			fmt.Printf("  %d. %s\n", i+1, db)
 		}
 	}
+	return failed
+}
+
+// configuredDatabaseCount is the number of databases listed explicitly
+// across all servers.
+func configuredDatabaseCount(cfg *config.Config) int {
+	count := 0
+	for _, server := range cfg.ServerList() {
+		count += len(server.Databases)
+	}
+	return count
+}
+
+// checkConfig prints every problem found in the configuration file and
+// returns the process exit code.
+func checkConfig(configFile string) int {
+	_, err := config.Load(configFile)
+	if err == nil {
+		fmt.Printf("%s: configuration is valid\n", configFile)
+		return 0
+	}
+
+	var validationErr *config.ValidationError
+	if !errors.As(err, &validationErr) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+		return 1
+	}
 
-	select {}
+	fmt.Fprintf(os.Stderr, "%s: %d problem(s) found:\n", configFile, len(validationErr.Problems))
+	for _, problem := range validationErr.Problems {
+		fmt.Fprintf(os.Stderr, "  - %s\n", problem)
+	}
+	return 1
 }
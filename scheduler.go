@@ -0,0 +1,213 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"pg-backup/internal/backup"
+	"pg-backup/internal/config"
+	"pg-backup/internal/health"
+	"pg-backup/internal/logger"
+
+	"github.com/robfig/cron/v3"
+)
+
+type scheduler struct {
+	configFile    string
+	cfg           *config.Config
+	cron          *cron.Cron
+	entries       map[string]cron.EntryID
+	backupService *backup.Service
+	healthService *health.Service
+	logger        *logger.Logger
+}
+
+func newScheduler(configFile string, cfg *config.Config, backupService *backup.Service, healthService *health.Service, appLogger *logger.Logger) *scheduler {
+	return &scheduler{
+		configFile:    configFile,
+		cfg:           cfg,
+		cron:          cron.New(),
+		entries:       make(map[string]cron.EntryID),
+		backupService: backupService,
+		healthService: healthService,
+		logger:        appLogger,
+	}
+}
+
+func (s *scheduler) run() {
+	s.logger.Info("Starting pg-backup scheduler")
+
+	entries, err := s.schedule(s.cfg)
+	if err != nil {
+		s.logger.Error("Failed to schedule backup: %v", err)
+		os.Exit(1)
+	}
+	s.entries = entries
+
+	s.cron.Start()
+	s.logger.Info("Backup scheduler started")
+
+	// Register before the initial backup so a SIGHUP sent while it runs is
+	// not lost.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	if s.cfg.RunOnStart {
+		s.logger.Info("Running initial backup")
+		start := time.Now()
+		dbCount, err := s.backupService.BackupAll()
+		if err != nil {
+			s.logger.Error("Initial backup failed: %v", err)
+		} else {
+			s.logger.Info("Initial backup completed successfully for %d databases", dbCount)
+			s.healthService.UpdateBackupStats(time.Now(), start.Add(24*time.Hour), 1, dbCount)
+		}
+	}
+
+	for range hangup {
+		s.reload()
+	}
+}
+
+// schedule adds one cron entry per distinct schedule, each backing up the
+// servers that use it. Entries are keyed by "<schedule> <servers>" so a
+// reload can tell which ones changed.
+func (s *scheduler) schedule(cfg *config.Config) (map[string]cron.EntryID, error) {
+	var schedules []string
+	servers := make(map[string][]string)
+	for _, server := range cfg.ServerList() {
+		schedule := cfg.ScheduleFor(server)
+		if _, ok := servers[schedule]; !ok {
+			schedules = append(schedules, schedule)
+		}
+		servers[schedule] = append(servers[schedule], server.Name)
+	}
+
+	entries := make(map[string]cron.EntryID)
+	for _, schedule := range schedules {
+		names := servers[schedule]
+		key := schedule + " " + strings.Join(names, ",")
+		if entryID, ok := s.entries[key]; ok {
+			entries[key] = entryID
+			continue
+		}
+
+		entryID, err := s.cron.AddFunc(schedule, func() { s.scheduledBackup(names) })
+		if err != nil {
+			for newKey, newID := range entries {
+				if _, existing := s.entries[newKey]; !existing {
+					s.cron.Remove(newID)
+				}
+			}
+			return nil, err
+		}
+		entries[key] = entryID
+		if len(cfg.Servers) == 0 {
+			s.logger.Info("Scheduled backup with cron: %s", schedule)
+			continue
+		}
+		for _, name := range names {
+			s.logger.Info("Scheduled server %s with cron: %s", name, schedule)
+		}
+	}
+
+	if cfg.Verification.Enabled && cfg.Verification.Schedule != "" {
+		key := "verify " + cfg.Verification.Schedule
+		if entryID, ok := s.entries[key]; ok {
+			entries[key] = entryID
+		} else {
+			entryID, err := s.cron.AddFunc(cfg.Verification.Schedule, s.scheduledVerification)
+			if err != nil {
+				for newKey, newID := range entries {
+					if _, existing := s.entries[newKey]; !existing {
+						s.cron.Remove(newID)
+					}
+				}
+				return nil, err
+			}
+			entries[key] = entryID
+			s.logger.Info("Scheduled backup verification with cron: %s", cfg.Verification.Schedule)
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *scheduler) scheduledBackup(servers []string) {
+	s.logger.Info("Starting scheduled backup")
+	start := time.Now()
+	dbCount, err := s.backupService.BackupServers(servers)
+	if err != nil {
+		s.logger.Error("Backup failed: %v", err)
+	} else {
+		s.logger.Info("Backup completed successfully for %d databases", dbCount)
+		s.healthService.UpdateBackupStats(time.Now(), start.Add(24*time.Hour), 1, dbCount)
+	}
+}
+
+func (s *scheduler) scheduledVerification() {
+	s.logger.Info("Starting scheduled backup verification")
+	verified, err := s.backupService.Verify("")
+	if err != nil {
+		s.logger.Error("Backup verification failed: %v", err)
+		return
+	}
+	s.logger.Info("Backup verification completed successfully for %d backups", verified)
+}
+
+// reload re-reads the configuration file after a SIGHUP. The new settings
+// are only applied once they load, validate and produce a working storage
+// provider; otherwise the running configuration is kept. A backup that is
+// already running finishes with the settings it started with.
+func (s *scheduler) reload() {
+	s.logger.Info("Received SIGHUP, reloading configuration from %s", s.configFile)
+
+	cfg, err := config.Load(s.configFile)
+	if err != nil {
+		s.logger.Error("Configuration reload failed, keeping current configuration: %v", err)
+		return
+	}
+
+	storageProvider, err := newStorageProvider(cfg)
+	if err != nil {
+		s.logger.Error("Configuration reload failed, keeping current configuration: %v", err)
+		return
+	}
+
+	changes := config.Diff(s.cfg, cfg)
+	if len(changes) == 0 {
+		s.logger.Info("Configuration reloaded, no changes")
+		return
+	}
+	for _, change := range changes {
+		s.logger.Info("Configuration change: %s", change)
+	}
+
+	entries, err := s.schedule(cfg)
+	if err != nil {
+		s.logger.Error("Configuration reload failed, keeping current configuration: %v", err)
+		return
+	}
+	for key, entryID := range s.entries {
+		if _, ok := entries[key]; !ok {
+			s.cron.Remove(entryID)
+		}
+	}
+	s.entries = entries
+
+	if cfg.LogFile != s.cfg.LogFile {
+		s.logger.Warning("log_file change requires a restart to take effect")
+	}
+	if cfg.HealthCheckPort != s.cfg.HealthCheckPort {
+		s.logger.Warning("health_check_port change requires a restart to take effect")
+	}
+
+	s.backupService.Reload(cfg, storageProvider)
+	s.healthService.SetDatabaseCount(configuredDatabaseCount(cfg))
+	s.cfg = cfg
+
+	s.logger.Info("Configuration reloaded")
+}